@@ -0,0 +1,146 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/routes"
+	"my-ecomm/services"
+	"my-ecomm/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin_RegularUserForbidden(t *testing.T) {
+	registerResponse := registerUser(t, "rbac")
+	token := registerResponse["token"].(string)
+	assert.Equal(t, "user", registerResponse["user"].(map[string]interface{})["role"])
+
+	resp, _, err := makeRequest("GET", API_BASE+"/admin/users", nil, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _, err = makeRequest("PUT", API_BASE+"/admin/users/1/role", map[string]string{"role": "admin"}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _, err = makeRequest("GET", API_BASE+"/users", nil, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// Runs in process against its own database, roles can't be granted over HTTP
+func TestAdmin_ModeratorCannotActOnAdmins(t *testing.T) {
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "admin.db"))
+	previous := config.DB
+	config.InitDB()
+	t.Cleanup(func() { config.DB = previous })
+
+	createUser := func(name, role string) *models.User {
+		user := models.User{Email: name + "@example.com", Name: name, Username: name, Password: "password123", Role: role}
+		assert.NoError(t, config.DB.Create(&user).Error)
+		session := models.Session{UserID: user.ID, RefreshTokenHash: name, ExpiresAt: time.Now().Add(time.Hour)}
+		assert.NoError(t, config.DB.Create(&session).Error)
+		return &user
+	}
+	admin := createUser("admin_user", models.RoleAdmin)
+	moderator := createUser("moderator_user", models.RoleModerator)
+	user := createUser("regular_user", models.RoleUser)
+	activeSessions := func(userID uint) int64 {
+		var count int64
+		config.DB.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Count(&count)
+		return count
+	}
+
+	adminService := services.NewAdminService()
+	_, err := adminService.BanUser(moderator.ID, admin.ID, "")
+	assert.EqualError(t, err, "insufficient permissions")
+	assert.EqualError(t, adminService.ForceLogout(moderator.ID, admin.ID), "insufficient permissions")
+	assert.Equal(t, int64(1), activeSessions(admin.ID))
+
+	// A ban placed by an admin can't be lifted by a moderator either
+	config.DB.Model(admin).Update("banned_at", time.Now())
+	_, err = adminService.UnbanUser(moderator.ID, admin.ID)
+	assert.EqualError(t, err, "insufficient permissions")
+	var banned models.User
+	config.DB.First(&banned, admin.ID)
+	assert.NotNil(t, banned.BannedAt)
+
+	// Regular users are fair game
+	assert.NoError(t, adminService.ForceLogout(moderator.ID, user.ID))
+	assert.Equal(t, int64(0), activeSessions(user.ID))
+}
+
+// Runs in process with its own server, roles can't be granted over HTTP
+func TestAdmin_ForceLogoutClosesAPIKeySockets(t *testing.T) {
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "apikeysockets.db"))
+	t.Setenv("JWT_DEV_EPHEMERAL_KEY", "true")
+	previous := config.DB
+	config.InitDB()
+	t.Cleanup(func() { config.DB = previous })
+	assert.NoError(t, utils.InitKeys())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes.SetupRoutes(router)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	admin := models.User{Email: "admin@example.com", Name: "Admin", Username: "admin_user", Password: "password123", Role: models.RoleAdmin}
+	bot := models.User{Email: "bot@example.com", Name: "Bot", Username: "bot_user", Password: "password123"}
+	for _, user := range []*models.User{&admin, &bot} {
+		assert.NoError(t, config.DB.Create(user).Error)
+	}
+	room := models.ChatRoom{Name: "Bots", IsGroup: true, CreatorID: bot.ID}
+	assert.NoError(t, config.DB.Create(&room).Error)
+	assert.NoError(t, config.DB.Create(&models.RoomMember{RoomID: room.ID, UserID: bot.ID, Role: models.RoomRoleOwner}).Error)
+	_, key, err := services.NewAPIKeyService().CreateAPIKey(bot.ID, "bot", []string{models.ScopeChatRead}, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"room_id": room.ID})
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/chat/ws-ticket", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "ApiKey "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var ticket struct {
+		Ticket string `json:"ticket"`
+	}
+	json.NewDecoder(resp.Body).Decode(&ticket)
+	resp.Body.Close()
+
+	wsURL := fmt.Sprintf("%s/api/v1/chat/rooms/%d/ws?ticket=%s", strings.Replace(server.URL, "http", "ws", 1), room.ID, ticket.Ticket)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	assert.NoError(t, services.NewAdminService().ForceLogout(admin.ID, bot.ID))
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var netErr interface{ Timeout() bool }
+			if assert.Error(t, err) && errors.As(err, &netErr) {
+				assert.False(t, netErr.Timeout(), "socket still open after force logout")
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// apiKeyRequest is makeRequest with the ApiKey authorization scheme
+func apiKeyRequest(method, url string, body interface{}, key string) (*http.Response, error) {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "ApiKey "+key)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestAPIKey_ScopesAndRevocation(t *testing.T) {
+	registerResponse := registerUser(t, "apikey")
+	token := registerResponse["token"].(string)
+
+	payload := map[string]interface{}{"name": "reader bot", "scopes": []string{"chat:read"}}
+	resp, body, err := makeRequest("POST", API_BASE+"/api-keys", payload, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var created map[string]interface{}
+	json.Unmarshal(body, &created)
+	key := created["key"].(string)
+	keyID := created["api_key"].(map[string]interface{})["ID"]
+
+	// Granted scope
+	resp, err = apiKeyRequest("GET", API_BASE+"/chat/rooms", nil, key)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Missing scope
+	resp, err = apiKeyRequest("POST", API_BASE+"/chat/rooms", map[string]interface{}{"name": "bot room"}, key)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Keys can't manage keys
+	resp, err = apiKeyRequest("GET", API_BASE+"/api-keys", nil, key)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _, err = makeRequest("DELETE", fmt.Sprintf("%s/api-keys/%v", API_BASE, keyID), nil, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = apiKeyRequest("GET", API_BASE+"/chat/rooms", nil, key)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAPIKey_InvalidScope(t *testing.T) {
+	registerResponse := registerUser(t, "apikey")
+
+	payload := map[string]interface{}{"name": "bot", "scopes": []string{"everything"}}
+	resp, _, err := makeRequest("POST", API_BASE+"/api-keys", payload, registerResponse["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
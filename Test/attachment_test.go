@@ -0,0 +1,106 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// uploadAttachment posts content as the multipart "file" field
+func uploadAttachment(t *testing.T, token string, roomID uint, fileName string, content []byte) (*http.Response, map[string]interface{}) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", fileName)
+	assert.NoError(t, err)
+	part.Write(content)
+	writer.Close()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/attachments", API_BASE, roomID), &body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	var response map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return resp, response
+}
+
+func download(t *testing.T, token, path string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", API_BASE+path[len("/api/v1"):], nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestAttachments_UploadSendAndDownload(t *testing.T) {
+	alice := registerUser(t, "attach")
+	bob := registerUser(t, "attach")
+	carol := registerUser(t, "attach")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+
+	img := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	for x := 0; x < 800; x++ {
+		for y := 0; y < 400; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var content bytes.Buffer
+	assert.NoError(t, png.Encode(&content, img))
+
+	// The name says text, the content type is sniffed from the bytes
+	resp, response := uploadAttachment(t, aliceToken, roomID, "photo.txt", content.Bytes())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	attachment, _ := response["attachment"].(map[string]interface{})
+	if !assert.NotNil(t, attachment) {
+		return
+	}
+	assert.Equal(t, "image/png", attachment["content_type"])
+	assert.Equal(t, float64(800), attachment["width"])
+	url := attachment["url"].(string)
+
+	// Not sent yet: only the uploader sees it
+	resp, _ = download(t, bobToken, url)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = uploadAttachment(t, carol["token"].(string), roomID, "x.txt", []byte("hello"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, body, _ := makeRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID),
+		map[string]interface{}{"attachment_ids": []interface{}{attachment["id"]}}, aliceToken)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Contains(t, string(body), `"file_name":"photo.txt"`)
+
+	resp, downloaded := download(t, bobToken, url)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.Equal(t, content.Bytes(), downloaded)
+
+	resp, thumbnail := download(t, bobToken, attachment["thumbnail_url"].(string))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if cfg, err := png.DecodeConfig(bytes.NewReader(thumbnail)); assert.NoError(t, err) {
+		assert.Equal(t, 320, cfg.Width)
+		assert.Equal(t, 160, cfg.Height)
+	}
+
+	resp, _ = download(t, carol["token"].(string), url)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
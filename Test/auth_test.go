@@ -5,10 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/routes"
+	"my-ecomm/services"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -337,3 +344,124 @@ func TestLogin_WithCustomHeaders(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+func TestForgotPassword_UnknownEmail(t *testing.T) {
+	payload := map[string]interface{}{
+		"email": generateUniqueEmail("nobody"),
+	}
+
+	// Same response whether or not the account exists
+	resp, body, err := makeRequest("POST", API_BASE+"/auth/forgot-password", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(body, &response)
+	assert.NoError(t, err)
+	assert.Contains(t, response, "message")
+}
+
+func TestResetPassword_InvalidToken(t *testing.T) {
+	payload := map[string]interface{}{
+		"token":    "invalid-token-here",
+		"password": "newpassword123",
+	}
+
+	resp, body, err := makeRequest("POST", API_BASE+"/auth/reset-password", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(body, &response)
+	assert.NoError(t, err)
+	assert.Contains(t, response, "error")
+}
+
+func TestVerifyEmail_InvalidToken(t *testing.T) {
+	payload := map[string]interface{}{
+		"token": "invalid-token-here",
+	}
+
+	resp, _, err := makeRequest("POST", API_BASE+"/auth/verify-email", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestLogin_UniformErrorAndLockout(t *testing.T) {
+	email := generateUniqueEmail("lockout")
+	registerPayload := map[string]interface{}{
+		"email":    email,
+		"password": "correctpassword",
+		"name":     "Test User",
+	}
+	makeRequest("POST", API_BASE+"/auth/register", registerPayload, "")
+
+	// Unknown email and wrong password must be indistinguishable
+	_, unknownBody, _ := makeRequest("POST", API_BASE+"/auth/login", map[string]interface{}{
+		"email":    generateUniqueEmail("nonexistent"),
+		"password": "wrongpassword",
+	}, "")
+	_, wrongBody, _ := makeRequest("POST", API_BASE+"/auth/login", map[string]interface{}{
+		"email":    email,
+		"password": "wrongpassword",
+	}, "")
+	assert.JSONEq(t, string(unknownBody), string(wrongBody))
+
+	// The default limit is 5 failures per account
+	var resp *http.Response
+	for i := 0; i < 5; i++ {
+		resp, _, _ = makeRequest("POST", API_BASE+"/auth/login", map[string]interface{}{
+			"email":    email,
+			"password": "wrongpassword",
+		}, "")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// Even the right password is refused while locked
+	resp, _, err := makeRequest("POST", API_BASE+"/auth/login", map[string]interface{}{
+		"email":    email,
+		"password": "correctpassword",
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+// Runs in process with its own router and throttle, so locking out the test
+// client's IP doesn't affect the other tests
+func TestLogin_ForwardedForDoesNotResetIPLockout(t *testing.T) {
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "proxy.db"))
+	t.Setenv("TRUSTED_PROXIES", "")
+	previous := config.DB
+	config.InitDB()
+	t.Cleanup(func() { config.DB = previous })
+
+	throttle := services.NewLoginThrottle(services.NewMemoryLoginAttemptStore())
+	throttle.IPLimit = 3
+	services.SetLoginThrottle(throttle)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	assert.NoError(t, router.SetTrustedProxies(config.TrustedProxies()))
+	routes.SetupRoutes(router)
+
+	login := func(i int) int {
+		payload, _ := json.Marshal(map[string]interface{}{"email": generateUniqueEmail("proxy"), "password": "wrongpassword"})
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.0.%d", i))
+		req.RemoteAddr = "192.0.2.1:4321"
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusBadRequest, login(i))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, login(3))
+
+	// The audit records carry the connection's IP, not the forged one
+	var forged int64
+	config.DB.Model(&models.FailedLogin{}).Where("ip_address <> ?", "192.0.2.1").Count(&forged)
+	assert.Zero(t, forged)
+}
@@ -0,0 +1,932 @@
+package controllers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to create a group room and return its ID
+func createRoom(t *testing.T, token string, memberIDs ...uint) uint {
+	payload := map[string]interface{}{"name": "Test Room", "member_ids": memberIDs}
+	resp, body, err := makeRequest("POST", API_BASE+"/chat/rooms", payload, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var response struct {
+		Room struct {
+			ID uint `json:"ID"`
+		} `json:"room"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &response))
+	return response.Room.ID
+}
+
+func wsTicket(t *testing.T, token string, roomID uint) (*http.Response, string) {
+	resp, body, err := makeRequest("POST", API_BASE+"/chat/ws-ticket", map[string]interface{}{"room_id": roomID}, token)
+	assert.NoError(t, err)
+
+	var response map[string]interface{}
+	json.Unmarshal(body, &response)
+	ticket, _ := response["ticket"].(string)
+	return resp, ticket
+}
+
+func wsURL(roomID uint, query string) string {
+	return fmt.Sprintf("%s/chat/rooms/%d/ws?%s", strings.Replace(API_BASE, "http", "ws", 1), roomID, query)
+}
+
+func TestWebSocket_TicketIsSingleUse(t *testing.T) {
+	token := registerUser(t, "ws")["token"].(string)
+	roomID := createRoom(t, token)
+
+	resp, ticket := wsTicket(t, token, roomID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, ticket)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(roomID, "ticket="+ticket), nil)
+	assert.NoError(t, err)
+	if conn != nil {
+		conn.Close()
+	}
+
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL(roomID, "ticket="+ticket), nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestWebSocket_RejectsQueryToken(t *testing.T) {
+	token := registerUser(t, "ws")["token"].(string)
+	roomID := createRoom(t, token)
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(roomID, "token="+token), nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestWebSocket_TicketRequiresMembership(t *testing.T) {
+	owner := registerUser(t, "ws")["token"].(string)
+	outsider := registerUser(t, "ws")["token"].(string)
+	roomID := createRoom(t, owner)
+
+	resp, _ := wsTicket(t, outsider, roomID)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestWebSocket_RemovedMemberCannotConnect(t *testing.T) {
+	owner := registerUser(t, "ws")["token"].(string)
+	member := registerUser(t, "ws")
+	memberID := uint(member["user"].(map[string]interface{})["ID"].(float64))
+	roomID := createRoom(t, owner, memberID)
+
+	// Ticket issued while still a member
+	_, ticket := wsTicket(t, member["token"].(string), roomID)
+	makeRequest("DELETE", fmt.Sprintf("%s/chat/rooms/%d/members/%d", API_BASE, roomID, memberID), nil, owner)
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(roomID, "ticket="+ticket), nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+// Helper to post a message and return its ID
+func sendMessage(t *testing.T, token string, roomID uint, content string) uint {
+	resp, body, err := makeRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID), map[string]interface{}{"content": content}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var response struct {
+		Data struct {
+			ID uint `json:"ID"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &response))
+	return response.Data.ID
+}
+
+func TestReadReceipts_PerMemberCursor(t *testing.T) {
+	alice := registerUser(t, "reader")
+	bob := registerUser(t, "reader")
+	outsider := registerUser(t, "reader")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	bobID := uint(bob["user"].(map[string]interface{})["ID"].(float64))
+
+	roomID := createRoom(t, aliceToken, bobID)
+	first := sendMessage(t, aliceToken, roomID, "first")
+	second := sendMessage(t, aliceToken, roomID, "second")
+
+	resp, _, err := makeRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/read", API_BASE, roomID), map[string]interface{}{"message_id": first}, bobToken)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _, err = makeRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/read", API_BASE, roomID), map[string]interface{}{"message_id": first}, outsider["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	_, body, err := makeRequest("GET", fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID), nil, aliceToken)
+	assert.NoError(t, err)
+	var response struct {
+		Messages []struct {
+			ID     uint   `json:"ID"`
+			IsRead bool   `json:"is_read"`
+			SeenBy []uint `json:"seen_by"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &response))
+	for _, message := range response.Messages {
+		switch message.ID {
+		case first:
+			assert.True(t, message.IsRead)
+			assert.Equal(t, []uint{bobID}, message.SeenBy)
+		case second:
+			assert.False(t, message.IsRead)
+			assert.Empty(t, message.SeenBy)
+		}
+	}
+
+	_, body, err = makeRequest("GET", fmt.Sprintf("%s/chat/messages/%d/seen-by", API_BASE, second), nil, aliceToken)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"seen_by":[]`)
+}
+
+func TestRoomList_UnreadAndMentionCounts(t *testing.T) {
+	alice := registerUser(t, "summary")
+	bob := registerUser(t, "summary")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	bobUser := bob["user"].(map[string]interface{})
+
+	roomID := createRoom(t, aliceToken, uint(bobUser["ID"].(float64)))
+	sendMessage(t, aliceToken, roomID, "hi @"+bobUser["username"].(string))
+	sendMessage(t, aliceToken, roomID, "last one")
+
+	_, body, err := makeRequest("GET", API_BASE+"/chat/rooms", nil, bobToken)
+	assert.NoError(t, err)
+	var rooms struct {
+		Rooms []struct {
+			ID          uint `json:"ID"`
+			LastMessage struct {
+				Content string `json:"content"`
+			} `json:"last_message"`
+			UnreadCount  int `json:"unread_count"`
+			MentionCount int `json:"mention_count"`
+		} `json:"rooms"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &rooms))
+	if assert.Len(t, rooms.Rooms, 1) {
+		assert.Equal(t, roomID, rooms.Rooms[0].ID)
+		assert.Equal(t, "last one", rooms.Rooms[0].LastMessage.Content)
+		assert.Equal(t, 2, rooms.Rooms[0].UnreadCount)
+		assert.Equal(t, 1, rooms.Rooms[0].MentionCount)
+	}
+
+	// The sender has nothing unread
+	_, body, _ = makeRequest("GET", API_BASE+"/chat/unread", nil, aliceToken)
+	assert.JSONEq(t, `{"total_unread":0,"total_mentions":0,"rooms_with_unread":0}`, string(body))
+
+	makeRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/read", API_BASE, roomID), nil, bobToken)
+	_, body, _ = makeRequest("GET", API_BASE+"/chat/unread", nil, bobToken)
+	assert.JSONEq(t, `{"total_unread":0,"total_mentions":0,"rooms_with_unread":0}`, string(body))
+}
+
+func TestMessages_CursorPagination(t *testing.T) {
+	token := registerUser(t, "history")["token"].(string)
+	roomID := createRoom(t, token)
+
+	var ids []uint
+	for i := 0; i < 5; i++ {
+		ids = append(ids, sendMessage(t, token, roomID, fmt.Sprintf("message %d", i)))
+	}
+
+	type page struct {
+		Messages []struct {
+			ID uint `json:"ID"`
+		} `json:"messages"`
+		NextCursor *uint `json:"next_cursor"`
+		PrevCursor *uint `json:"prev_cursor"`
+	}
+	load := func(query string) (page, []uint) {
+		_, body, err := makeRequest("GET", fmt.Sprintf("%s/chat/rooms/%d/messages?%s", API_BASE, roomID, query), nil, token)
+		assert.NoError(t, err)
+		var p page
+		assert.NoError(t, json.Unmarshal(body, &p))
+		var got []uint
+		for _, m := range p.Messages {
+			got = append(got, m.ID)
+		}
+		return p, got
+	}
+
+	latest, got := load("limit=2")
+	assert.Equal(t, []uint{ids[4], ids[3]}, got)
+	assert.Nil(t, latest.PrevCursor)
+	if assert.NotNil(t, latest.NextCursor) {
+		assert.Equal(t, ids[3], *latest.NextCursor)
+	}
+
+	older, got := load(fmt.Sprintf("limit=2&before=%d", *latest.NextCursor))
+	assert.Equal(t, []uint{ids[2], ids[1]}, got)
+	assert.NotNil(t, older.PrevCursor)
+	assert.NotNil(t, older.NextCursor)
+
+	_, got = load(fmt.Sprintf("limit=2&after=%d", ids[1]))
+	assert.Equal(t, []uint{ids[3], ids[2]}, got)
+
+	_, got = load(fmt.Sprintf("limit=3&around=%d", ids[2]))
+	assert.Equal(t, []uint{ids[3], ids[2], ids[1]}, got)
+
+	resp, _, _ := makeRequest("GET", fmt.Sprintf("%s/chat/rooms/%d/messages?before=1&after=2", API_BASE, roomID), nil, token)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestMessages_EditHistoryAndTombstone(t *testing.T) {
+	alice := registerUser(t, "edit")
+	bob := registerUser(t, "edit")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+	messageID := sendMessage(t, aliceToken, roomID, "helo")
+	messageURL := fmt.Sprintf("%s/chat/messages/%d", API_BASE, messageID)
+
+	resp, _, err := makeRequest("PUT", messageURL, map[string]interface{}{"content": "hello"}, bobToken)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _, _ = makeRequest("PUT", messageURL, map[string]interface{}{"content": "  \n"}, aliceToken)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body, err := makeRequest("PUT", messageURL, map[string]interface{}{"content": "hello"}, aliceToken)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"content":"hello"`)
+	assert.NotContains(t, string(body), `"edited_at":null`)
+
+	_, body, _ = makeRequest("GET", messageURL+"/edits", nil, bobToken)
+	var edits struct {
+		Edits []struct {
+			PreviousContent string `json:"previous_content"`
+		} `json:"edits"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &edits))
+	if assert.Len(t, edits.Edits, 1) {
+		assert.Equal(t, "helo", edits.Edits[0].PreviousContent)
+	}
+
+	resp, _, err = makeRequest("DELETE", messageURL, nil, aliceToken)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body, _ = makeRequest("GET", fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID), nil, bobToken)
+	var history struct {
+		Messages []struct {
+			ID        uint   `json:"ID"`
+			Content   string `json:"content"`
+			IsDeleted bool   `json:"is_deleted"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &history))
+	if assert.Len(t, history.Messages, 1) {
+		assert.Equal(t, messageID, history.Messages[0].ID)
+		assert.True(t, history.Messages[0].IsDeleted)
+		assert.Empty(t, history.Messages[0].Content)
+	}
+}
+
+func TestThreads_RepliesAndCounts(t *testing.T) {
+	alice := registerUser(t, "thread")
+	bob := registerUser(t, "thread")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+	parentID := sendMessage(t, aliceToken, roomID, "thread starter")
+
+	messagesURL := fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID)
+	resp, body, err := makeRequest("POST", messagesURL, map[string]interface{}{"content": "reply", "parent_id": parentID}, bobToken)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var reply struct {
+		Data struct {
+			ID uint `json:"ID"`
+		} `json:"data"`
+	}
+	json.Unmarshal(body, &reply)
+
+	// A reply to a reply lands in the same thread
+	resp, body, _ = makeRequest("POST", messagesURL, map[string]interface{}{"content": "nested", "parent_id": reply.Data.ID}, aliceToken)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Contains(t, string(body), fmt.Sprintf(`"parent_id":%d`, parentID))
+
+	_, body, _ = makeRequest("GET", messagesURL, nil, bobToken)
+	var history struct {
+		Messages []struct {
+			ID         uint `json:"ID"`
+			ReplyCount int  `json:"reply_count"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &history))
+	if assert.Len(t, history.Messages, 1) {
+		assert.Equal(t, parentID, history.Messages[0].ID)
+		assert.Equal(t, 2, history.Messages[0].ReplyCount)
+	}
+
+	_, body, _ = makeRequest("GET", fmt.Sprintf("%s/chat/messages/%d/thread", API_BASE, parentID), nil, bobToken)
+	var thread struct {
+		Replies      []map[string]interface{} `json:"replies"`
+		Participants []map[string]interface{} `json:"participants"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &thread))
+	assert.Len(t, thread.Replies, 2)
+	assert.Len(t, thread.Participants, 2)
+}
+
+func TestThreads_DeletingLastReplyRollsBack(t *testing.T) {
+	alice := registerUser(t, "thread")
+	bob := registerUser(t, "thread")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+	parentID := sendMessage(t, aliceToken, roomID, "thread starter")
+
+	messagesURL := fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID)
+	var replies [2]struct {
+		Data struct {
+			ID        uint   `json:"ID"`
+			CreatedAt string `json:"CreatedAt"`
+		} `json:"data"`
+	}
+	for i := range replies {
+		if i > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		resp, body, err := makeRequest("POST", messagesURL, map[string]interface{}{"content": "reply", "parent_id": parentID}, bobToken)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		json.Unmarshal(body, &replies[i])
+	}
+
+	// Replies stay out of the room list preview
+	_, body, _ := makeRequest("GET", API_BASE+"/chat/rooms", nil, aliceToken)
+	var rooms struct {
+		Rooms []struct {
+			LastMessage struct {
+				ID uint `json:"ID"`
+			} `json:"last_message"`
+		} `json:"rooms"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &rooms))
+	if assert.Len(t, rooms.Rooms, 1) {
+		assert.Equal(t, parentID, rooms.Rooms[0].LastMessage.ID)
+	}
+
+	resp, _, _ := makeRequest("DELETE", fmt.Sprintf("%s/chat/messages/%d", API_BASE, replies[1].Data.ID), nil, bobToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body, _ = makeRequest("GET", messagesURL, nil, aliceToken)
+	var history struct {
+		Messages []struct {
+			ID          uint       `json:"ID"`
+			ReplyCount  int        `json:"reply_count"`
+			LastReplyAt *time.Time `json:"last_reply_at"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &history))
+	if assert.Len(t, history.Messages, 1) && assert.NotNil(t, history.Messages[0].LastReplyAt) {
+		remaining, _ := time.Parse(time.RFC3339Nano, replies[0].Data.CreatedAt)
+		assert.Equal(t, 1, history.Messages[0].ReplyCount)
+		assert.True(t, remaining.Equal(*history.Messages[0].LastReplyAt))
+	}
+
+	// With no replies left the thread has no last reply
+	makeRequest("DELETE", fmt.Sprintf("%s/chat/messages/%d", API_BASE, replies[0].Data.ID), nil, bobToken)
+	_, body, _ = makeRequest("GET", messagesURL, nil, aliceToken)
+	assert.NoError(t, json.Unmarshal(body, &history))
+	if assert.Len(t, history.Messages, 1) {
+		assert.Equal(t, 0, history.Messages[0].ReplyCount)
+		assert.Nil(t, history.Messages[0].LastReplyAt)
+	}
+}
+
+func TestReactions_AggregatedInHistory(t *testing.T) {
+	alice := registerUser(t, "react")
+	bob := registerUser(t, "react")
+	carol := registerUser(t, "react")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+	messageID := sendMessage(t, aliceToken, roomID, "react to me")
+	reactionsURL := fmt.Sprintf("%s/chat/messages/%d/reactions", API_BASE, messageID)
+
+	for _, token := range []string{aliceToken, bobToken, bobToken} {
+		resp, _, err := makeRequest("POST", reactionsURL, map[string]interface{}{"emoji": "👍"}, token)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	resp, _, _ := makeRequest("POST", reactionsURL, map[string]interface{}{"emoji": "🎉"}, bobToken)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, _, _ = makeRequest("POST", reactionsURL, map[string]interface{}{"emoji": "👍"}, carol["token"].(string))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", reactionsURL, map[string]interface{}{"emoji": "not an emoji"}, bobToken)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _, _ = makeRequest("DELETE", reactionsURL+"/"+url.PathEscape("🎉"), nil, bobToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body, _ := makeRequest("GET", fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID), nil, aliceToken)
+	var history struct {
+		Messages []struct {
+			Reactions []struct {
+				Emoji   string `json:"emoji"`
+				Count   int    `json:"count"`
+				Reacted bool   `json:"reacted"`
+			} `json:"reactions"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &history))
+	if assert.Len(t, history.Messages, 1) && assert.Len(t, history.Messages[0].Reactions, 1) {
+		reaction := history.Messages[0].Reactions[0]
+		assert.Equal(t, "👍", reaction.Emoji)
+		assert.Equal(t, 2, reaction.Count)
+		assert.True(t, reaction.Reacted)
+	}
+}
+
+func TestSearch_CallerRoomsOnly(t *testing.T) {
+	alice := registerUser(t, "search")
+	bob := registerUser(t, "search")
+	carol := registerUser(t, "search")
+	aliceToken, bobToken, carolToken := alice["token"].(string), bob["token"].(string), carol["token"].(string)
+	bobID := uint(bob["user"].(map[string]interface{})["ID"].(float64))
+	roomID := createRoom(t, aliceToken, bobID)
+	otherRoomID := createRoom(t, carolToken)
+
+	word := fmt.Sprintf("quokka%d", time.Now().UnixNano())
+	sendMessage(t, aliceToken, roomID, "Have you seen the "+word+" <today>?")
+	sendMessage(t, bobToken, roomID, "Yes, the "+word+" was here")
+	sendMessage(t, aliceToken, roomID, "unrelated")
+	sendMessage(t, carolToken, otherRoomID, word+" in another room")
+
+	search := func(query string) (*http.Response, map[string]interface{}) {
+		resp, body, err := makeRequest("GET", API_BASE+"/chat/search?"+query, nil, aliceToken)
+		assert.NoError(t, err)
+		var page map[string]interface{}
+		json.Unmarshal(body, &page)
+		return resp, page
+	}
+
+	resp, page := search("q=" + word)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	results, _ := page["results"].([]interface{})
+	if assert.Len(t, results, 2) {
+		newest := results[0].(map[string]interface{})
+		assert.Equal(t, "Yes, the <mark>"+word+"</mark> was here", newest["snippet"])
+		oldest := results[1].(map[string]interface{})
+		assert.Contains(t, oldest["snippet"], "&lt;today&gt;")
+	}
+
+	_, page = search("limit=1&q=" + word)
+	assert.Equal(t, true, page["has_more"])
+	_, page = search(fmt.Sprintf("limit=1&before=%v&q=%s", page["next_cursor"], word))
+	assert.Len(t, page["results"], 1)
+	assert.Equal(t, false, page["has_more"])
+
+	_, page = search(fmt.Sprintf("sender_id=%d&q=%s", bobID, word))
+	assert.Len(t, page["results"], 1)
+
+	resp, _ = search(fmt.Sprintf("room_id=%d&q=%s", otherRoomID, word))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestSearch_DateRangeInAnyOffset(t *testing.T) {
+	alice := registerUser(t, "searchdates")
+	aliceToken := alice["token"].(string)
+	roomID := createRoom(t, aliceToken)
+
+	word := fmt.Sprintf("wombat%d", time.Now().UnixNano())
+	sendMessage(t, aliceToken, roomID, "The "+word+" arrived")
+
+	count := func(name string, at time.Time) int {
+		query := url.Values{"q": {word}, name: {at.Format(time.RFC3339)}}
+		_, body, err := makeRequest("GET", API_BASE+"/chat/search?"+query.Encode(), nil, aliceToken)
+		assert.NoError(t, err)
+		var page struct {
+			Results []interface{} `json:"results"`
+		}
+		json.Unmarshal(body, &page)
+		return len(page.Results)
+	}
+
+	// The same instants written with offsets on either side of the server's
+	east, west := time.FixedZone("UTC+14", 14*3600), time.FixedZone("UTC-11", -11*3600)
+	before, after := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	assert.Equal(t, 1, count("from", before.In(east)))
+	assert.Equal(t, 1, count("to", after.In(west)))
+	assert.Equal(t, 0, count("from", after.In(west)))
+	assert.Equal(t, 0, count("to", before.In(east)))
+}
+
+func TestMentions_NotifiedAcrossRoomsAndInbox(t *testing.T) {
+	alice := registerUser(t, "mention")
+	bob := registerUser(t, "mention")
+	carol := registerUser(t, "mention")
+	aliceToken, bobToken, carolToken := alice["token"].(string), bob["token"].(string), carol["token"].(string)
+	bobUser := bob["user"].(map[string]interface{})
+	bobID := uint(bobUser["ID"].(float64))
+	carolID := uint(carol["user"].(map[string]interface{})["ID"].(float64))
+	roomID := createRoom(t, aliceToken, bobID, carolID)
+	otherRoomID := createRoom(t, aliceToken, bobID)
+
+	// Bob only listens on the other room's socket
+	_, ticket := wsTicket(t, bobToken, otherRoomID)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(otherRoomID, "ticket="+ticket), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	messageID := sendMessage(t, aliceToken, roomID, "ping @"+bobUser["username"].(string)+". and alice@example.com")
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		var event map[string]interface{}
+		if err := conn.ReadJSON(&event); !assert.NoError(t, err) {
+			break
+		}
+		if event["type"] == "mention" {
+			assert.Equal(t, float64(roomID), event["room_id"])
+			assert.Equal(t, "user", event["kind"])
+			break
+		}
+	}
+
+	sendMessage(t, carolToken, roomID, "hello @room")
+
+	inbox := func(token, query string) []interface{} {
+		_, body, err := makeRequest("GET", API_BASE+"/chat/mentions?"+query, nil, token)
+		assert.NoError(t, err)
+		var page map[string]interface{}
+		json.Unmarshal(body, &page)
+		mentions, _ := page["mentions"].([]interface{})
+		return mentions
+	}
+
+	mentions := inbox(bobToken, "")
+	if assert.Len(t, mentions, 2) {
+		assert.Equal(t, "room", mentions[0].(map[string]interface{})["kind"])
+		assert.Equal(t, float64(messageID), mentions[1].(map[string]interface{})["message_id"])
+	}
+	assert.Len(t, inbox(aliceToken, ""), 1)
+	assert.Empty(t, inbox(carolToken, ""))
+
+	makeRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/read", API_BASE, roomID), nil, bobToken)
+	assert.Empty(t, inbox(bobToken, ""))
+	assert.Len(t, inbox(bobToken, "all=true"), 2)
+}
+
+func TestPinsAndStars_SurviveEditsNotDeletes(t *testing.T) {
+	alice := registerUser(t, "pin")
+	bob := registerUser(t, "pin")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+	messageID := sendMessage(t, aliceToken, roomID, "meeting at 10")
+	messageURL := fmt.Sprintf("%s/chat/messages/%d", API_BASE, messageID)
+	pinsURL := fmt.Sprintf("%s/chat/rooms/%d/pins", API_BASE, roomID)
+
+	// Only the room admin pins, any member stars
+	resp, _, _ := makeRequest("POST", messageURL+"/pin", nil, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", messageURL+"/pin", nil, aliceToken)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", messageURL+"/star", nil, bobToken)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	makeRequest("PUT", messageURL, map[string]interface{}{"content": "meeting at 11"}, aliceToken)
+
+	_, body, _ := makeRequest("GET", pinsURL, nil, bobToken)
+	assert.Contains(t, string(body), "meeting at 11")
+	_, body, _ = makeRequest("GET", API_BASE+"/chat/starred", nil, bobToken)
+	assert.Contains(t, string(body), "meeting at 11")
+	_, body, _ = makeRequest("GET", fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID), nil, bobToken)
+	assert.Contains(t, string(body), `"is_pinned":true,"is_starred":true`)
+
+	makeRequest("DELETE", messageURL, nil, aliceToken)
+
+	_, body, _ = makeRequest("GET", pinsURL, nil, bobToken)
+	assert.JSONEq(t, `{"pins":[]}`, string(body))
+	_, body, _ = makeRequest("GET", API_BASE+"/chat/starred", nil, bobToken)
+	assert.Contains(t, string(body), `"starred":[]`)
+}
+
+func TestRoomRoles_RemoveLeaveAndTransfer(t *testing.T) {
+	alice := registerUser(t, "roles")
+	bob := registerUser(t, "roles")
+	carol := registerUser(t, "roles")
+	dave := registerUser(t, "roles")
+	aliceToken, bobToken, carolToken := alice["token"].(string), bob["token"].(string), carol["token"].(string)
+	bobID := uint(bob["user"].(map[string]interface{})["ID"].(float64))
+	carolID := uint(carol["user"].(map[string]interface{})["ID"].(float64))
+	daveID := uint(dave["user"].(map[string]interface{})["ID"].(float64))
+	roomID := createRoom(t, aliceToken, bobID, carolID)
+	roomURL := fmt.Sprintf("%s/chat/rooms/%d", API_BASE, roomID)
+
+	// Plain members cannot add others
+	resp, _, _ := makeRequest("POST", roomURL+"/members", map[string]interface{}{"user_id": daveID}, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _, _ = makeRequest("PUT", fmt.Sprintf("%s/members/%d/role", roomURL, bobID), map[string]interface{}{"role": "admin"}, aliceToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, ticket := wsTicket(t, carolToken, roomID)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(roomID, "ticket="+ticket), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	resp, _, _ = makeRequest("DELETE", fmt.Sprintf("%s/members/%d", roomURL, carolID), nil, bobToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Carol is told and her socket for the room is closed
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var received strings.Builder
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			assert.True(t, websocket.IsCloseError(err, websocket.CloseNoStatusReceived))
+			break
+		}
+		received.Write(data)
+	}
+	assert.Contains(t, received.String(), `"type":"removed_from_room"`)
+	resp, _, _ = makeRequest("GET", roomURL+"/messages", nil, carolToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// The owner has to hand the room over before leaving
+	resp, _, _ = makeRequest("POST", roomURL+"/leave", nil, aliceToken)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", roomURL+"/transfer", map[string]interface{}{"user_id": bobID}, aliceToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", roomURL+"/leave", nil, aliceToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body, _ := makeRequest("GET", roomURL+"/members", nil, bobToken)
+	var members struct {
+		Members []struct {
+			User struct {
+				ID uint `json:"ID"`
+			} `json:"user"`
+			Role string `json:"role"`
+		} `json:"members"`
+	}
+	json.Unmarshal(body, &members)
+	if assert.Len(t, members.Members, 1) {
+		assert.Equal(t, bobID, members.Members[0].User.ID)
+		assert.Equal(t, "owner", members.Members[0].Role)
+	}
+
+	_, body, _ = makeRequest("GET", roomURL+"/messages", nil, bobToken)
+	assert.Contains(t, string(body), `"type":"system"`)
+	assert.Contains(t, string(body), "removed")
+	assert.Contains(t, string(body), "left")
+}
+
+func TestRoomSettings_PostPolicyAndSlowMode(t *testing.T) {
+	alice := registerUser(t, "settings")
+	bob := registerUser(t, "settings")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+	roomURL := fmt.Sprintf("%s/chat/rooms/%d", API_BASE, roomID)
+
+	resp, _, _ := makeRequest("PATCH", roomURL, map[string]interface{}{"topic": "mine now"}, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _, _ = makeRequest("PATCH", roomURL, map[string]interface{}{"settings": map[string]interface{}{"post_policy": "everyone"}}, aliceToken)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, ticket := wsTicket(t, bobToken, roomID)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(roomID, "ticket="+ticket), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	resp, body, _ := makeRequest("PATCH", roomURL, map[string]interface{}{
+		"topic":      "Release planning",
+		"avatar_url": "https://example.com/room.png",
+		"settings":   map[string]interface{}{"post_policy": "admins"},
+	}, aliceToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"post_policy":"admins"`)
+
+	// Reads up to the first event of the given type
+	waitFor := func(eventType string) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for {
+			var event map[string]interface{}
+			if err := conn.ReadJSON(&event); !assert.NoError(t, err) {
+				return nil
+			}
+			if event["type"] == eventType {
+				return event
+			}
+		}
+	}
+	if event := waitFor("room_updated"); event != nil {
+		assert.Equal(t, "Release planning", event["room"].(map[string]interface{})["topic"])
+	}
+
+	messagesURL := roomURL + "/messages"
+	resp, _, _ = makeRequest("POST", messagesURL, map[string]interface{}{"content": "can I?"}, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	makeRequest("PATCH", roomURL, map[string]interface{}{"settings": map[string]interface{}{"post_policy": "members", "slow_mode_seconds": 60}}, aliceToken)
+
+	resp, _, _ = makeRequest("POST", messagesURL, map[string]interface{}{"content": "first"}, bobToken)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", messagesURL, map[string]interface{}{"content": "second"}, bobToken)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// The WebSocket path is held to the same rules, admins are exempt
+	conn.WriteJSON(map[string]interface{}{"type": "message", "content": "via socket"})
+	if event := waitFor("error"); event != nil {
+		assert.Contains(t, event["content"], "slow mode")
+	}
+	sendMessage(t, aliceToken, roomID, "one")
+	sendMessage(t, aliceToken, roomID, "two")
+}
+
+func TestRoomSettings_SlowModeHoldsUnderConcurrentSends(t *testing.T) {
+	alice := registerUser(t, "slowmode")
+	bob := registerUser(t, "slowmode")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	roomID := createRoom(t, aliceToken, uint(bob["user"].(map[string]interface{})["ID"].(float64)))
+	roomURL := fmt.Sprintf("%s/chat/rooms/%d", API_BASE, roomID)
+	makeRequest("PATCH", roomURL, map[string]interface{}{"settings": map[string]interface{}{"slow_mode_seconds": 60}}, aliceToken)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _, err := makeRequest("POST", roomURL+"/messages", map[string]interface{}{"content": fmt.Sprintf("burst %d", i)}, bobToken)
+			if err == nil && resp.StatusCode == http.StatusCreated {
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, sent)
+}
+
+func TestInvites_JoinPreviewAndLimits(t *testing.T) {
+	alice := registerUser(t, "invite")
+	bob := registerUser(t, "invite")
+	carol := registerUser(t, "invite")
+	aliceToken, bobToken, carolToken := alice["token"].(string), bob["token"].(string), carol["token"].(string)
+	roomID := createRoom(t, aliceToken)
+	invitesURL := fmt.Sprintf("%s/chat/rooms/%d/invites", API_BASE, roomID)
+
+	resp, _, _ := makeRequest("POST", invitesURL, nil, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	createInvite := func(payload map[string]interface{}) string {
+		resp, body, err := makeRequest("POST", invitesURL, payload, aliceToken)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		var response struct {
+			Invite struct {
+				Code string `json:"code"`
+			} `json:"invite"`
+		}
+		json.Unmarshal(body, &response)
+		return response.Invite.Code
+	}
+	code := createInvite(map[string]interface{}{"max_uses": 1, "expires_in_seconds": 3600})
+	inviteURL := API_BASE + "/chat/invites/" + code
+
+	resp, body, _ := makeRequest("GET", inviteURL, nil, bobToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"member_count":1`)
+	assert.Contains(t, string(body), `"is_member":false`)
+
+	resp, _, _ = makeRequest("POST", inviteURL+"/join", nil, bobToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", inviteURL+"/join", nil, bobToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", inviteURL+"/join", nil, carolToken)
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	revoked := createInvite(nil)
+	resp, _, _ = makeRequest("DELETE", API_BASE+"/chat/invites/"+revoked, nil, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	makeRequest("DELETE", API_BASE+"/chat/invites/"+revoked, nil, aliceToken)
+	resp, _, _ = makeRequest("POST", API_BASE+"/chat/invites/"+revoked+"/join", nil, carolToken)
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// Admins see who joined through which link
+	resp, _, _ = makeRequest("GET", invitesURL, nil, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, body, _ = makeRequest("GET", invitesURL, nil, aliceToken)
+	var listing struct {
+		Invites []struct {
+			Code  string `json:"code"`
+			Uses  int    `json:"uses"`
+			Joins []struct {
+				UserID uint `json:"user_id"`
+			} `json:"joins"`
+		} `json:"invites"`
+	}
+	json.Unmarshal(body, &listing)
+	if assert.Len(t, listing.Invites, 2) {
+		used := listing.Invites[1]
+		assert.Equal(t, code, used.Code)
+		assert.Equal(t, 1, used.Uses)
+		if assert.Len(t, used.Joins, 1) {
+			assert.Equal(t, uint(bob["user"].(map[string]interface{})["ID"].(float64)), used.Joins[0].UserID)
+		}
+	}
+}
+
+func TestInvites_DieWithCreatorMembershipAndRole(t *testing.T) {
+	alice := registerUser(t, "invitecreator")
+	bob := registerUser(t, "invitecreator")
+	carol := registerUser(t, "invitecreator")
+	aliceToken, bobToken, carolToken := alice["token"].(string), bob["token"].(string), carol["token"].(string)
+	bobID := uint(bob["user"].(map[string]interface{})["ID"].(float64))
+	carolID := uint(carol["user"].(map[string]interface{})["ID"].(float64))
+	roomID := createRoom(t, aliceToken, bobID, carolID)
+	roomURL := fmt.Sprintf("%s/chat/rooms/%d", API_BASE, roomID)
+
+	createInvite := func(token string) string {
+		resp, body, err := makeRequest("POST", roomURL+"/invites", nil, token)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		var response struct {
+			Invite struct {
+				Code string `json:"code"`
+			} `json:"invite"`
+		}
+		json.Unmarshal(body, &response)
+		return response.Invite.Code
+	}
+	for _, id := range []uint{bobID, carolID} {
+		makeRequest("PUT", fmt.Sprintf("%s/members/%d/role", roomURL, id), map[string]interface{}{"role": "admin"}, aliceToken)
+	}
+	bobCode := createInvite(bobToken)
+	carolCode := createInvite(carolToken)
+
+	// A removed member cannot come back through their own link
+	resp, _, _ := makeRequest("DELETE", fmt.Sprintf("%s/members/%d", roomURL, bobID), nil, aliceToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", API_BASE+"/chat/invites/"+bobCode+"/join", nil, bobToken)
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	resp, _, _ = makeRequest("GET", roomURL+"/messages", nil, bobToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Nor can anyone use a link of an admin since demoted
+	makeRequest("PUT", fmt.Sprintf("%s/members/%d/role", roomURL, carolID), map[string]interface{}{"role": "member"}, aliceToken)
+	resp, _, _ = makeRequest("POST", API_BASE+"/chat/invites/"+carolCode+"/join", nil, bobToken)
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestRoomRoles_DeletedOwnerHandsOver(t *testing.T) {
+	alice := registerUser(t, "handover")
+	bob := registerUser(t, "handover")
+	carol := registerUser(t, "handover")
+	aliceToken, bobToken := alice["token"].(string), bob["token"].(string)
+	bobID := uint(bob["user"].(map[string]interface{})["ID"].(float64))
+	carolID := uint(carol["user"].(map[string]interface{})["ID"].(float64))
+	roomID := createRoom(t, aliceToken, bobID, carolID)
+	roomURL := fmt.Sprintf("%s/chat/rooms/%d", API_BASE, roomID)
+
+	// The admin is preferred over the longer-standing member
+	makeRequest("PUT", fmt.Sprintf("%s/members/%d/role", roomURL, carolID), map[string]interface{}{"role": "admin"}, aliceToken)
+	resp, _, _ := makeRequest("DELETE", API_BASE+"/me", map[string]interface{}{"password": "password123"}, aliceToken)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body, _ := makeRequest("GET", roomURL+"/members", nil, bobToken)
+	var members struct {
+		Members []struct {
+			User struct {
+				ID uint `json:"ID"`
+			} `json:"user"`
+			Role string `json:"role"`
+		} `json:"members"`
+	}
+	json.Unmarshal(body, &members)
+	if assert.Len(t, members.Members, 2) {
+		assert.Equal(t, carolID, members.Members[0].User.ID)
+		assert.Equal(t, "owner", members.Members[0].Role)
+	}
+}
@@ -0,0 +1,99 @@
+package controllers_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"my-ecomm/utils"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+}
+
+// jwksKeyfunc resolves keys the way another service would, using only the JWKS endpoint
+func jwksKeyfunc(t *testing.T) jwt.Keyfunc {
+	resp, body, err := makeRequest("GET", BASE_URL+"/.well-known/jwks.json", nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &jwks))
+	assert.NotEmpty(t, jwks.Keys)
+
+	return func(token *jwt.Token) (interface{}, error) {
+		for _, key := range jwks.Keys {
+			if key.Kid != token.Header["kid"] {
+				continue
+			}
+			switch key.Kty {
+			case "RSA":
+				n, _ := base64.RawURLEncoding.DecodeString(key.N)
+				e, _ := base64.RawURLEncoding.DecodeString(key.E)
+				return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+			case "OKP":
+				x, _ := base64.RawURLEncoding.DecodeString(key.X)
+				return ed25519.PublicKey(x), nil
+			}
+		}
+		return nil, jwt.ErrTokenUnverifiable
+	}
+}
+
+func TestJWKS_VerifiesAccessToken(t *testing.T) {
+	registerResponse := registerUser(t, "jwks")
+	token := registerResponse["token"].(string)
+
+	parsed, err := jwt.Parse(token, jwksKeyfunc(t), jwt.WithIssuer("my-ecomm"), jwt.WithAudience("my-ecomm-api"))
+	assert.NoError(t, err)
+	assert.True(t, parsed.Valid)
+	assert.Equal(t, "at+jwt", parsed.Header["typ"])
+}
+
+// Tokens handed out before MFA is verified must not pass for access tokens
+func TestJWKS_PendingMFATokenDoesNotVerify(t *testing.T) {
+	registerResponse := registerUser(t, "jwksmfa")
+	token := registerResponse["token"].(string)
+	email := registerResponse["user"].(map[string]interface{})["email"]
+
+	_, body, _ := makeRequest("POST", API_BASE+"/auth/mfa/setup", nil, token)
+	var setupResponse map[string]interface{}
+	json.Unmarshal(body, &setupResponse)
+	code, _ := utils.TOTPCode(setupResponse["secret"].(string), time.Now())
+	makeRequest("POST", API_BASE+"/auth/mfa/enable", map[string]interface{}{"code": code}, token)
+
+	_, body, _ = makeRequest("POST", API_BASE+"/auth/login", map[string]interface{}{"email": email, "password": "password123"}, "")
+	var loginResponse map[string]interface{}
+	json.Unmarshal(body, &loginResponse)
+	mfaToken, _ := loginResponse["mfa_token"].(string)
+	if !assert.NotEmpty(t, mfaToken) {
+		return
+	}
+	_, err := jwt.Parse(mfaToken, jwksKeyfunc(t))
+	assert.Error(t, err)
+}
+
+func TestJWKS_RejectsUnsignedToken(t *testing.T) {
+	claims := jwt.MapClaims{"UserID": 1, "SessionID": 1}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.NoError(t, err)
+
+	resp, _, err := makeRequest("GET", API_BASE+"/products", nil, unsigned)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,111 @@
+package controllers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"my-ecomm/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMFA_EnrollAndLoginWithRecoveryCode(t *testing.T) {
+	registerResponse := registerUser(t, "mfa")
+	token := registerResponse["token"].(string)
+	email := registerResponse["user"].(map[string]interface{})["email"]
+
+	// Start enrollment
+	resp, body, err := makeRequest("POST", API_BASE+"/auth/mfa/setup", nil, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var setupResponse map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &setupResponse))
+	secret := setupResponse["secret"].(string)
+	assert.Contains(t, setupResponse["provisioning_uri"], "otpauth://totp/")
+
+	// Confirm with a code from the "authenticator"
+	code, err := utils.TOTPCode(secret, time.Now())
+	assert.NoError(t, err)
+	resp, body, err = makeRequest("POST", API_BASE+"/auth/mfa/enable", map[string]interface{}{"code": code}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var enableResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &enableResponse))
+	assert.Len(t, enableResponse.RecoveryCodes, 10)
+
+	// Password alone no longer yields a token
+	loginPayload := map[string]interface{}{"email": email, "password": "password123"}
+	resp, body, err = makeRequest("POST", API_BASE+"/auth/login", loginPayload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var loginResponse map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &loginResponse))
+	assert.Equal(t, true, loginResponse["mfa_required"])
+	assert.NotContains(t, loginResponse, "token")
+
+	// A pending MFA token is not an access token
+	resp, _, err = makeRequest("GET", API_BASE+"/products", nil, loginResponse["mfa_token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	verifyPayload := map[string]interface{}{
+		"mfa_token": loginResponse["mfa_token"],
+		"code":      enableResponse.RecoveryCodes[0],
+	}
+	resp, body, err = makeRequest("POST", API_BASE+"/auth/mfa/verify", verifyPayload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var verifyResponse map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &verifyResponse))
+	assert.NotEmpty(t, verifyResponse["token"])
+
+	// Recovery codes are single use
+	_, body, err = makeRequest("POST", API_BASE+"/auth/login", loginPayload, "")
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(body, &loginResponse))
+	verifyPayload["mfa_token"] = loginResponse["mfa_token"]
+	resp, _, err = makeRequest("POST", API_BASE+"/auth/mfa/verify", verifyPayload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestMFA_WrongCodesLockTheAccount(t *testing.T) {
+	registerResponse := registerUser(t, "mfalock")
+	token := registerResponse["token"].(string)
+	email := registerResponse["user"].(map[string]interface{})["email"]
+
+	_, body, _ := makeRequest("POST", API_BASE+"/auth/mfa/setup", nil, token)
+	var setupResponse map[string]interface{}
+	json.Unmarshal(body, &setupResponse)
+	code, _ := utils.TOTPCode(setupResponse["secret"].(string), time.Now())
+	resp, _, _ := makeRequest("POST", API_BASE+"/auth/mfa/enable", map[string]interface{}{"code": code}, token)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A fresh pending token per try doesn't reset the count: the right
+	// password is not a successful login until the code is verified
+	loginPayload := map[string]interface{}{"email": email, "password": "password123"}
+	for i := 0; i < 5; i++ {
+		resp, body, _ := makeRequest("POST", API_BASE+"/auth/login", loginPayload, "")
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		var loginResponse map[string]interface{}
+		json.Unmarshal(body, &loginResponse)
+		resp, _, _ = makeRequest("POST", API_BASE+"/auth/mfa/verify", map[string]interface{}{
+			"mfa_token": loginResponse["mfa_token"],
+			"code":      "000000",
+		}, "")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp, _, _ = makeRequest("POST", API_BASE+"/auth/login", loginPayload, "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
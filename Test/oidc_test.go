@@ -0,0 +1,233 @@
+package controllers_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// The server must be started with the stub provider configured:
+//
+//	OIDC_PROVIDERS=stub
+//	OIDC_STUB_ISSUER=http://127.0.0.1:9096
+//	OIDC_STUB_CLIENT_ID=chat-app
+//	OIDC_STUB_REDIRECT_URL=http://localhost:8080/api/v1/auth/oidc/stub/callback
+const (
+	stubIssuerAddr = "127.0.0.1:9096"
+	stubIssuer     = "http://" + stubIssuerAddr
+	stubClientID   = "chat-app"
+)
+
+// stubIssuerServer is a minimal OpenID Connect provider that signs in a fixed user
+type stubIssuerServer struct {
+	key   *rsa.PrivateKey
+	kid   string
+	email string
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorize params
+}
+
+func startStubIssuer(t *testing.T, email string) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	// Fresh kid per run so the server refetches the JWKS
+	stub := &stubIssuerServer{key: key, kid: fmt.Sprintf("stub-%d", time.Now().UnixNano()), email: email, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stubIssuer,
+			"authorization_endpoint": stubIssuer + "/authorize",
+			"token_endpoint":         stubIssuer + "/token",
+			"jwks_uri":               stubIssuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": stub.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", stub.token)
+
+	listener, err := net.Listen("tcp", stubIssuerAddr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", stubIssuerAddr, err)
+	}
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+
+	t.Cleanup(server.Close)
+	stubInstance = stub
+	return server
+}
+
+var stubInstance *stubIssuerServer
+
+// authorize simulates the user approving the login at the provider
+func (s *stubIssuerServer) authorize(params url.Values) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := "code-" + params.Get("state")
+	s.codes[code] = params
+	return code
+}
+
+func (s *stubIssuerServer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	s.mu.Lock()
+	params, ok := s.codes[r.Form.Get("code")]
+	delete(s.codes, r.Form.Get("code"))
+	s.mu.Unlock()
+
+	// PKCE: the verifier must hash to the challenge sent to /authorize
+	challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != params.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            stubIssuer,
+		"aud":            stubClientID,
+		"sub":            "stub|" + s.email,
+		"email":          s.email,
+		"email_verified": true,
+		"name":           "Stub User",
+		"nonce":          params.Get("nonce"),
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	})
+	idToken.Header["kid"] = s.kid
+	signed, _ := idToken.SignedString(s.key)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "stub-access-token",
+		"token_type":   "Bearer",
+		"id_token":     signed,
+	})
+}
+
+// Don't follow the redirect to the provider
+var noRedirectClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// oidcStart starts a login and returns the callback URL the provider would
+// send the browser to, with the state cookie the browser got
+func oidcStart(t *testing.T) (string, []*http.Cookie) {
+	resp, err := noRedirectClient.Get(API_BASE + "/auth/oidc/stub/start")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		t.Skip("stub OIDC provider not configured on the server")
+	}
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	assert.NoError(t, err)
+	params := location.Query()
+	assert.Equal(t, "S256", params.Get("code_challenge_method"))
+	assert.Equal(t, stubClientID, params.Get("client_id"))
+
+	code := stubInstance.authorize(params)
+	callback := API_BASE + "/auth/oidc/stub/callback?code=" + url.QueryEscape(code) + "&state=" + url.QueryEscape(params.Get("state"))
+	return callback, resp.Cookies()
+}
+
+func oidcCallback(t *testing.T, callback string, cookies []*http.Cookie) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest("GET", callback, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+
+	var response map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return resp, response
+}
+
+func oidcLogin(t *testing.T) (*http.Response, map[string]interface{}) {
+	callback, cookies := oidcStart(t)
+	return oidcCallback(t, callback, cookies)
+}
+
+func TestOIDC_LoginCreatesUser(t *testing.T) {
+	email := generateUniqueEmail("oidc")
+	startStubIssuer(t, email)
+
+	resp, response := oidcLogin(t)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, response, "user")
+	assert.NotEmpty(t, response["token"])
+	assert.Equal(t, email, response["user"].(map[string]interface{})["email"])
+
+	// Second login links to the same user
+	resp, second := oidcLogin(t)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, response["user"].(map[string]interface{})["ID"], second["user"].(map[string]interface{})["ID"])
+}
+
+func TestOIDC_CallbackRejectsUnknownState(t *testing.T) {
+	startStubIssuer(t, generateUniqueEmail("oidc"))
+
+	resp, _, err := makeRequest("GET", API_BASE+"/auth/oidc/stub/callback?code=abc&state=forged", nil, "")
+	assert.NoError(t, err)
+	if resp.StatusCode == http.StatusNotFound {
+		t.Skip("stub OIDC provider not configured on the server")
+	}
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// A callback URL opened in a browser other than the one that started the
+// login must not sign that browser in (login CSRF)
+func TestOIDC_CallbackRequiresStateCookie(t *testing.T) {
+	startStubIssuer(t, generateUniqueEmail("oidc"))
+
+	callback, cookies := oidcStart(t)
+	if assert.Len(t, cookies, 1) {
+		assert.True(t, cookies[0].HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+	}
+
+	resp, _ := oidcCallback(t, callback, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, otherCookies := oidcStart(t)
+	resp, _ = oidcCallback(t, callback, otherCookies)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = oidcCallback(t, callback, cookies)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
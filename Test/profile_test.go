@@ -0,0 +1,229 @@
+package controllers_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/services"
+	"my-ecomm/utils"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfile_UpdateUsernameCaseInsensitive(t *testing.T) {
+	first := registerUser(t, "profile")
+	second := registerUser(t, "profile")
+	assert.NotEmpty(t, first["user"].(map[string]interface{})["username"])
+
+	username := fmt.Sprintf("Profile_%d", time.Now().UnixNano()%1000000)
+	resp, body, err := makeRequest("PATCH", API_BASE+"/me", map[string]interface{}{"username": username, "name": "Renamed"}, first["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var response map[string]interface{}
+	json.Unmarshal(body, &response)
+	assert.Equal(t, username, response["user"].(map[string]interface{})["username"])
+	assert.Equal(t, "Renamed", response["user"].(map[string]interface{})["name"])
+
+	resp, _, err = makeRequest("PATCH", API_BASE+"/me", map[string]interface{}{"username": strings.ToLower(username)}, second["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// A trailing dot would be cut off by @mentions
+	resp, _, err = makeRequest("PATCH", API_BASE+"/me", map[string]interface{}{"username": username + "."}, second["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestProfile_ChangePasswordRevokesOtherSessions(t *testing.T) {
+	registerResponse := registerUser(t, "password")
+	token := registerResponse["token"].(string)
+	email := registerResponse["user"].(map[string]interface{})["email"]
+
+	_, body, err := makeRequest("POST", API_BASE+"/auth/login", map[string]interface{}{"email": email, "password": "password123"}, "")
+	assert.NoError(t, err)
+	var other map[string]interface{}
+	json.Unmarshal(body, &other)
+
+	// Wrong current password
+	resp, _, err := makeRequest("POST", API_BASE+"/me/password", map[string]interface{}{"current_password": "nope", "new_password": "newpassword123"}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _, err = makeRequest("POST", API_BASE+"/me/password", map[string]interface{}{"current_password": "password123", "new_password": "newpassword123"}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _, _ = makeRequest("GET", API_BASE+"/me", nil, token)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, _ = makeRequest("GET", API_BASE+"/me", nil, other["token"].(string))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestProfile_ExportAndDeleteAccount(t *testing.T) {
+	registerResponse := registerUser(t, "delete")
+	token := registerResponse["token"].(string)
+	user := registerResponse["user"].(map[string]interface{})
+	roomID := createRoom(t, token)
+
+	resp, _, err := makeRequest("POST", fmt.Sprintf("%s/chat/rooms/%d/messages", API_BASE, roomID), map[string]interface{}{"content": "hello"}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, body, err := makeRequest("GET", API_BASE+"/me/export", nil, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if assert.NoError(t, err) {
+		var names []string
+		for _, f := range archive.File {
+			names = append(names, f.Name)
+		}
+		assert.ElementsMatch(t, []string{"profile.json", "rooms.json", "products.json", "messages.json"}, names)
+	}
+
+	resp, _, err = makeRequest("DELETE", API_BASE+"/me", map[string]interface{}{"password": "wrong"}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _, err = makeRequest("DELETE", API_BASE+"/me", map[string]interface{}{"password": "password123"}, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Signed out everywhere and unable to log back in
+	resp, _, _ = makeRequest("GET", API_BASE+"/me", nil, token)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _, _ = makeRequest("POST", API_BASE+"/auth/login", map[string]interface{}{"email": user["email"], "password": "password123"}, "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// Runs in process against its own database, accounts without a password are
+// only created through a social login
+func TestProfile_DeleteAccountConfirmation(t *testing.T) {
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "delete.db"))
+	previous := config.DB
+	config.InitDB()
+	t.Cleanup(func() { config.DB = previous })
+
+	createUser := func(name, password string, loggedInAgo time.Duration) (*models.User, uint) {
+		user := models.User{Email: name + "@example.com", Name: name, Username: name, Password: password}
+		if password != "" {
+			assert.NoError(t, user.HashPassword())
+		}
+		assert.NoError(t, config.DB.Create(&user).Error)
+		assert.NoError(t, config.DB.Create(&models.UserIdentity{UserID: user.ID, Provider: "stub", Subject: name}).Error)
+		session := models.Session{UserID: user.ID, RefreshTokenHash: name, ExpiresAt: time.Now().Add(time.Hour)}
+		session.CreatedAt = time.Now().Add(-loggedInAgo)
+		assert.NoError(t, config.DB.Create(&session).Error)
+		return &user, session.ID
+	}
+	accountService := services.NewAccountService()
+
+	// A linked social login doesn't stand in for a password the account has
+	linked, sessionID := createUser("linked_user", "password123", 0)
+	_, err := accountService.DeleteAccount(linked.ID, sessionID, "", "")
+	assert.EqualError(t, err, "invalid password")
+	_, err = accountService.DeleteAccount(linked.ID, sessionID, "password123", "")
+	assert.NoError(t, err)
+
+	// Without a password the session has to be fresh
+	stale, sessionID := createUser("stale_user", "", time.Hour)
+	_, err = accountService.DeleteAccount(stale.ID, sessionID, "", "")
+	assert.EqualError(t, err, "recent login required")
+	fresh, sessionID := createUser("fresh_user", "", 0)
+	_, err = accountService.DeleteAccount(fresh.ID, sessionID, "", "")
+	assert.NoError(t, err)
+
+	// With MFA on it takes a current code instead, however fresh the session
+	secret, _ := utils.GenerateTOTPSecret()
+	mfa, sessionID := createUser("mfa_user", "", 0)
+	config.DB.Model(mfa).Updates(map[string]interface{}{"totp_enabled": true, "totp_secret": secret})
+	_, err = accountService.DeleteAccount(mfa.ID, sessionID, "", "000000")
+	assert.EqualError(t, err, "invalid code")
+	code, _ := utils.TOTPCode(secret, time.Now())
+	_, err = accountService.DeleteAccount(mfa.ID, sessionID, "", code)
+	assert.NoError(t, err)
+}
+
+func TestProfile_PurgeRemovesPersonalData(t *testing.T) {
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "purge.db"))
+	t.Setenv("ACCOUNT_DELETION_GRACE", "0s")
+	previous := config.DB
+	config.InitDB()
+	t.Cleanup(func() { config.DB = previous })
+	previousStorage := services.GetStorage()
+	storage := &services.LocalStorage{Dir: t.TempDir()}
+	services.SetStorage(storage)
+	t.Cleanup(func() { services.SetStorage(previousStorage) })
+
+	alice := models.User{Email: "purged@example.com", Name: "Purged", Username: "purged_user", Password: "password123"}
+	assert.NoError(t, alice.HashPassword())
+	bob := models.User{Email: "kept@example.com", Name: "Kept", Username: "kept_user", Password: "password123"}
+	for _, user := range []*models.User{&alice, &bob} {
+		assert.NoError(t, config.DB.Create(user).Error)
+	}
+	room := models.ChatRoom{Name: "Purge", IsGroup: true, CreatorID: bob.ID}
+	assert.NoError(t, config.DB.Create(&room).Error)
+	assert.NoError(t, config.DB.Create(&models.RoomMember{RoomID: room.ID, UserID: bob.ID, Role: models.RoomRoleOwner}).Error)
+	assert.NoError(t, config.DB.Create(&models.RoomMember{RoomID: room.ID, UserID: alice.ID, Role: models.RoomRoleAdmin}).Error)
+
+	own := models.Message{Type: models.MessageTypeText, Content: "edited", RoomID: room.ID, SenderID: alice.ID}
+	other := models.Message{Type: models.MessageTypeText, Content: "hello", RoomID: room.ID, SenderID: bob.ID}
+	assert.NoError(t, config.DB.Create(&own).Error)
+	assert.NoError(t, config.DB.Create(&other).Error)
+
+	assert.NoError(t, storage.Put("rooms/photo.png", strings.NewReader("image"), 5, "image/png"))
+	assert.NoError(t, storage.Put("rooms/photo_thumb.png", strings.NewReader("thumb"), 5, "image/png"))
+	invite := models.RoomInvite{RoomID: room.ID, Code: "purge-invite", CreatedByID: alice.ID}
+	for _, record := range []interface{}{
+		&models.Attachment{RoomID: room.ID, UploaderID: alice.ID, MessageID: &own.ID, FileName: "photo.png", ContentType: "image/png", Size: 5, StorageKey: "rooms/photo.png", ThumbnailKey: "rooms/photo_thumb.png"},
+		&models.Reaction{MessageID: other.ID, UserID: alice.ID, Emoji: "👍"},
+		&models.MessageEdit{MessageID: own.ID, EditorID: alice.ID, PreviousContent: "original", EditedAt: time.Now()},
+		&models.PinnedMessage{RoomID: room.ID, MessageID: other.ID, PinnedByID: alice.ID},
+		&invite,
+	} {
+		assert.NoError(t, config.DB.Create(record).Error)
+	}
+	assert.NoError(t, config.DB.Create(&models.RoomInviteJoin{InviteID: invite.ID, RoomID: room.ID, UserID: bob.ID}).Error)
+
+	accountService := services.NewAccountService()
+	assert.NoError(t, config.DB.Delete(&alice).Error)
+	purged, err := accountService.PurgeDeletedAccounts()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	for _, check := range []struct {
+		model interface{}
+		where string
+	}{
+		{&models.Attachment{}, "uploader_id = ?"},
+		{&models.Reaction{}, "user_id = ?"},
+		{&models.MessageEdit{}, "editor_id = ?"},
+		{&models.RoomInvite{}, "created_by_id = ?"},
+		{&models.PinnedMessage{}, "pinned_by_id = ?"},
+	} {
+		var count int64
+		config.DB.Model(check.model).Where(check.where, alice.ID).Count(&count)
+		assert.Zero(t, count, "%T", check.model)
+	}
+	var joins int64
+	config.DB.Model(&models.RoomInviteJoin{}).Where("invite_id = ?", invite.ID).Count(&joins)
+	assert.Zero(t, joins)
+
+	// The files are gone, the pin stays with the room
+	for _, key := range []string{"rooms/photo.png", "rooms/photo_thumb.png"} {
+		_, err := storage.Get(key)
+		assert.ErrorIs(t, err, services.ErrObjectNotFound)
+	}
+	var pins int64
+	config.DB.Model(&models.PinnedMessage{}).Where("message_id = ?", other.ID).Count(&pins)
+	assert.Equal(t, int64(1), pins)
+}
@@ -0,0 +1,64 @@
+//go:build sqlite_fts5
+
+package controllers_test
+
+import (
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/services"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs in process against its own database, so the FTS5 index, its triggers
+// and the MATCH query are exercised whatever the server was built with:
+//
+//	go test -tags sqlite_fts5 -run TestSearchFTS ./Test
+func TestSearchFTS_IndexFollowsEditsAndDeletes(t *testing.T) {
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "fts.db"))
+	previous := config.DB
+	config.InitDB()
+	t.Cleanup(func() { config.DB = previous })
+	if !assert.True(t, config.MessageSearchFTS) {
+		return
+	}
+
+	user := models.User{Email: "fts@example.com", Name: "Fts", Username: "fts_user", Password: "password123"}
+	assert.NoError(t, config.DB.Create(&user).Error)
+	room := models.ChatRoom{Name: "FTS", IsGroup: true, CreatorID: user.ID}
+	assert.NoError(t, config.DB.Create(&room).Error)
+	assert.NoError(t, config.DB.Create(&models.RoomMember{RoomID: room.ID, UserID: user.ID, Role: models.RoomRoleOwner}).Error)
+
+	chat := services.NewChatService()
+	message, err := chat.SendMessage(services.SendMessageParams{RoomID: room.ID, SenderID: user.ID, Content: `Planning the "launch" review`})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	search := func(text string) []services.SearchResult {
+		page, err := chat.SearchMessages(user.ID, services.SearchQuery{Text: text})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return page.Results
+	}
+
+	// Terms match word prefixes and the snippet marks the match
+	results := search("plan")
+	if assert.Len(t, results, 1) {
+		assert.Contains(t, results[0].Snippet, "<mark>Planning</mark>")
+	}
+	// Quotes in the query are not FTS5 syntax
+	assert.Len(t, search(`"launch`), 1)
+	assert.Empty(t, search("lanning"))
+
+	_, err = chat.UpdateMessage(message.ID, user.ID, "Retro notes")
+	assert.NoError(t, err)
+	assert.Empty(t, search("planning"))
+	assert.Len(t, search("retro"), 1)
+
+	assert.NoError(t, chat.DeleteMessage(message.ID, user.ID))
+	assert.Empty(t, search("retro"))
+}
@@ -0,0 +1,131 @@
+package controllers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper to register a user and return the register response
+func registerUser(t *testing.T, prefix string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"email":    generateUniqueEmail(prefix),
+		"password": "password123",
+		"name":     "Session User",
+	}
+	resp, body, err := makeRequest("POST", API_BASE+"/auth/register", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(body, &response)
+	assert.NoError(t, err)
+	return response
+}
+
+func TestRefresh_RotatesRefreshToken(t *testing.T) {
+	registerResponse := registerUser(t, "refresh")
+	assert.NotEmpty(t, registerResponse["refresh_token"])
+
+	payload := map[string]interface{}{"refresh_token": registerResponse["refresh_token"]}
+	resp, body, err := makeRequest("POST", API_BASE+"/auth/refresh", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(body, &response)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, response["token"])
+	assert.NotEqual(t, registerResponse["refresh_token"], response["refresh_token"])
+
+	// The new access token works
+	resp, _, err = makeRequest("GET", API_BASE+"/products", nil, response["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Replaying the old refresh token fails and revokes the session
+	resp, _, err = makeRequest("POST", API_BASE+"/auth/refresh", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _, err = makeRequest("GET", API_BASE+"/products", nil, response["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRefresh_InvalidToken(t *testing.T) {
+	payload := map[string]interface{}{"refresh_token": "not-a-real-token"}
+	resp, _, err := makeRequest("POST", API_BASE+"/auth/refresh", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestLogout_RevokesAccessToken(t *testing.T) {
+	registerResponse := registerUser(t, "logout")
+	token := registerResponse["token"].(string)
+
+	resp, _, err := makeRequest("POST", API_BASE+"/auth/logout", nil, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _, err = makeRequest("GET", API_BASE+"/products", nil, token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The refresh token of a revoked session is rejected too
+	payload := map[string]interface{}{"refresh_token": registerResponse["refresh_token"]}
+	resp, _, err = makeRequest("POST", API_BASE+"/auth/refresh", payload, "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestSessions_ListAndRevokeDevice(t *testing.T) {
+	registerResponse := registerUser(t, "devices")
+	user := registerResponse["user"].(map[string]interface{})
+
+	// Log in from a second device
+	loginPayload := map[string]interface{}{
+		"email":       user["email"],
+		"password":    "password123",
+		"device_name": "Test Phone",
+	}
+	_, body, err := makeRequest("POST", API_BASE+"/auth/login", loginPayload, "")
+	assert.NoError(t, err)
+	var loginResponse map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &loginResponse))
+	phoneToken := loginResponse["token"].(string)
+
+	resp, body, err := makeRequest("GET", API_BASE+"/auth/sessions", nil, registerResponse["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var sessionsResponse struct {
+		Sessions []struct {
+			ID         uint   `json:"ID"`
+			DeviceName string `json:"device_name"`
+			Current    bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &sessionsResponse))
+	assert.Len(t, sessionsResponse.Sessions, 2)
+
+	var phoneSessionID uint
+	for _, session := range sessionsResponse.Sessions {
+		if session.DeviceName == "Test Phone" {
+			phoneSessionID = session.ID
+			assert.False(t, session.Current)
+		}
+	}
+	assert.NotZero(t, phoneSessionID)
+
+	resp, _, err = makeRequest("DELETE", fmt.Sprintf("%s/auth/sessions/%d", API_BASE, phoneSessionID), nil, registerResponse["token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _, err = makeRequest("GET", API_BASE+"/products", nil, phoneToken)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
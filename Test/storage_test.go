@@ -0,0 +1,75 @@
+package controllers_test
+
+import (
+	"io"
+	"my-ecomm/services"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// s3StandIn is an in-memory stand-in for an S3-compatible service
+type s3StandIn struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=test-key/") ||
+		!strings.Contains(auth, "/us-east-1/s3/aws4_request") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		s.objects[r.URL.Path] = body
+	case http.MethodGet:
+		body, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Storage_RoundTrip(t *testing.T) {
+	standIn := &s3StandIn{objects: make(map[string][]byte)}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	storage := &services.S3Storage{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "chat",
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+	}
+
+	assert.NoError(t, storage.Put("attachments/1/a b", strings.NewReader("hello"), 5, "text/plain"))
+	assert.Contains(t, standIn.objects, "/chat/attachments/1/a b")
+
+	body, err := storage.Get("attachments/1/a b")
+	if assert.NoError(t, err) {
+		content, _ := io.ReadAll(body)
+		body.Close()
+		assert.Equal(t, "hello", string(content))
+	}
+
+	assert.NoError(t, storage.Delete("attachments/1/a b"))
+	_, err = storage.Get("attachments/1/a b")
+	assert.ErrorIs(t, err, services.ErrObjectNotFound)
+}
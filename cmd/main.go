@@ -4,6 +4,8 @@ import (
 	"log"
 	"my-ecomm/config"
 	"my-ecomm/routes"
+	"my-ecomm/services"
+	"my-ecomm/utils"
 	"os"
 
 	"github.com/gin-gonic/gin"
@@ -14,15 +16,24 @@ func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("Error loading .env file")
 	}
+	if err := utils.InitKeys(); err != nil {
+		log.Fatal("Failed to load JWT signing keys: ", err)
+	}
 	config.InitDB()
+	services.PromoteBootstrapAdmins()
+	services.NewAccountService().StartAccountPurgeJob()
+	services.NewAttachmentService().StartOrphanPurgeJob()
 
 	gin.SetMode(gin.ReleaseMode)
 
 	router := gin.Default()
+	if err := router.SetTrustedProxies(config.TrustedProxies()); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
 
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
 
 		if c.Request.Method == "OPTIONS" {
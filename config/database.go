@@ -21,13 +21,60 @@ func InitDB() {
 	if err != nil {
 		log.Fatal("failed to connect database", err)
 	}
+	if err := migrateActionTokens(); err != nil {
+		log.Fatal("failed to migrate action tokens", err)
+	}
 	//Auto Migrate the schema
-	if err := DB.AutoMigrate(&models.User{}, &models.Product{}, &models.ChatRoom{}, &models.Message{}, &models.RoomMember{}); err != nil {
+	if err := DB.AutoMigrate(&models.User{}, &models.Product{}, &models.ChatRoom{}, &models.Message{}, &models.RoomMember{}, &models.Session{}, &models.ActionToken{}, &models.RecoveryCode{}, &models.UserIdentity{}, &models.FailedLogin{}, &models.APIKey{}, &models.MessageEdit{}, &models.Reaction{}, &models.Attachment{}, &models.Mention{}, &models.PinnedMessage{}, &models.StarredMessage{}, &models.RoomInvite{}, &models.RoomInviteJoin{}); err != nil {
 		log.Fatal("failed to migrate database schema", err)
 	}
+	if err := migrateUsernames(); err != nil {
+		log.Fatal("failed to migrate usernames", err)
+	}
+	// History pages are read by room in message ID order
+	if err := DB.Exec("CREATE INDEX IF NOT EXISTS idx_messages_room_id_id ON messages(room_id, id)").Error; err != nil {
+		log.Fatal("failed to create message index", err)
+	}
+	if err := migrateRoomOwners(); err != nil {
+		log.Fatal("failed to migrate room owners", err)
+	}
+	if err := setupMessageSearch(); err != nil {
+		log.Fatal("failed to set up message search", err)
+	}
 	log.Println("Database connection establish and migrated successfully")
 }
 
+// migrateUsernames fills in usernames of accounts created before they were
+// set at registration, then makes them unique regardless of case
+func migrateUsernames() error {
+	if err := DB.Exec("UPDATE users SET username = 'user' || id WHERE username IS NULL OR username = ''").Error; err != nil {
+		return err
+	}
+	// Older accounts may differ only by case: keep the oldest, suffix the others
+	if err := DB.Exec("UPDATE users SET username = username || id WHERE id NOT IN (SELECT MIN(id) FROM users GROUP BY username COLLATE NOCASE)").Error; err != nil {
+		return err
+	}
+	return DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_nocase ON users(username COLLATE NOCASE)").Error
+}
+
+// migrateActionTokens drops the table of action tokens from when they were
+// signed JWTs. They are short-lived, so outstanding links just have to be
+// requested again.
+func migrateActionTokens() error {
+	if !DB.Migrator().HasColumn(&models.ActionToken{}, "jti") {
+		return nil
+	}
+	return DB.Migrator().DropTable(&models.ActionToken{})
+}
+
+// migrateRoomOwners makes the creator of each group the owner of rooms
+// created before members had roles
+func migrateRoomOwners() error {
+	return DB.Exec(`UPDATE room_members SET role = 'owner'
+		WHERE user_id = (SELECT creator_id FROM chat_rooms WHERE chat_rooms.id = room_members.room_id AND chat_rooms.is_group)
+		AND NOT EXISTS (SELECT 1 FROM room_members owners WHERE owners.room_id = room_members.room_id AND owners.role = 'owner')`).Error
+}
+
 func GetDB() *gorm.DB {
 	return DB
 }
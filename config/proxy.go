@@ -0,0 +1,20 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// TrustedProxies lists the proxies (IPs or CIDRs, comma separated in
+// TRUSTED_PROXIES) whose X-Forwarded-For header gives the client IP. None are
+// trusted by default, so clients can't pick the IP the login throttle and
+// audit records see.
+func TrustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
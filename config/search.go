@@ -0,0 +1,68 @@
+package config
+
+import "log"
+
+// MessageSearchFTS tells whether message search runs on the messages_fts
+// index. It needs SQLite built with FTS5 (go build -tags sqlite_fts5);
+// without it search falls back to a LIKE scan.
+var MessageSearchFTS bool
+
+var messageSearchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages
+	WHEN new.deleted_at IS NULL BEGIN
+		INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content, deleted_at ON messages BEGIN
+		DELETE FROM messages_fts WHERE rowid = old.id;
+		INSERT INTO messages_fts(rowid, content) SELECT new.id, new.content WHERE new.deleted_at IS NULL;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		DELETE FROM messages_fts WHERE rowid = old.id;
+	END`,
+}
+
+// setupMessageSearch creates the full-text index of live messages, kept in
+// sync by triggers, and fills it when the triggers are new
+func setupMessageSearch() error {
+	var enabled bool
+	if err := DB.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled).Error; err != nil {
+		return err
+	}
+	if !enabled {
+		log.Println("SQLite built without FTS5, message search falls back to LIKE")
+		// Triggers left by an FTS5 build would make every message write fail
+		for _, name := range []string{"messages_fts_insert", "messages_fts_update", "messages_fts_delete"} {
+			if err := DB.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := DB.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content)").Error; err != nil {
+		return err
+	}
+
+	var existing int64
+	if err := DB.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'messages_fts_%'").Scan(&existing).Error; err != nil {
+		return err
+	}
+	for _, trigger := range messageSearchTriggers {
+		if err := DB.Exec(trigger).Error; err != nil {
+			return err
+		}
+	}
+
+	// Messages written while the index wasn't maintained are missing from it
+	if existing < int64(len(messageSearchTriggers)) {
+		if err := DB.Exec("DELETE FROM messages_fts").Error; err != nil {
+			return err
+		}
+		if err := DB.Exec("INSERT INTO messages_fts(rowid, content) SELECT id, content FROM messages WHERE deleted_at IS NULL").Error; err != nil {
+			return err
+		}
+	}
+
+	MessageSearchFTS = true
+	return nil
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"my-ecomm/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminController struct {
+	adminService *services.AdminService
+}
+
+func NewAdminController() *AdminController {
+	return &AdminController{
+		adminService: services.NewAdminService(),
+	}
+}
+
+type BanUserInput struct {
+	Reason string `json:"reason"`
+}
+
+type ChangeRoleInput struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// ListUsers returns every user including role and ban status
+func (ac *AdminController) ListUsers(c *gin.Context) {
+	users, err := ac.adminService.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// BanUser bans a user and signs them out
+func (ac *AdminController) BanUser(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var input BanUserInput
+	if err := c.ShouldBindJSON(&input); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := ac.adminService.BanUser(c.GetUint("userID"), uint(userID), input.Reason)
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User banned", "user": user})
+}
+
+// UnbanUser lifts a ban
+func (ac *AdminController) UnbanUser(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	user, err := ac.adminService.UnbanUser(c.GetUint("userID"), uint(userID))
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User unbanned", "user": user})
+}
+
+// ChangeRole sets the role of a user
+func (ac *AdminController) ChangeRole(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var input ChangeRoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := ac.adminService.ChangeRole(c.GetUint("userID"), uint(userID), input.Role)
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated", "user": user})
+}
+
+// ForceLogout revokes every session of a user
+func (ac *AdminController) ForceLogout(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := ac.adminService.ForceLogout(c.GetUint("userID"), uint(userID)); err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User logged out from all sessions"})
+}
+
+func adminErrorStatus(err error) int {
+	switch err.Error() {
+	case "user not found":
+		return http.StatusNotFound
+	case "insufficient permissions":
+		return http.StatusForbidden
+	case "cannot ban yourself", "cannot change your own role", "invalid role":
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"my-ecomm/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyController struct {
+	apiKeyService *services.APIKeyService
+}
+
+func NewAPIKeyController() *APIKeyController {
+	return &APIKeyController{
+		apiKeyService: services.NewAPIKeyService(),
+	}
+}
+
+type CreateAPIKeyInput struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"required"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"min=0"` // 0 = never expires
+}
+
+// CreateAPIKey issues a key. The plaintext key is only shown in this response.
+func (ac *APIKeyController) CreateAPIKey(c *gin.Context) {
+	var input CreateAPIKeyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, plaintext, err := ac.apiKeyService.CreateAPIKey(
+		c.GetUint("userID"),
+		input.Name,
+		input.Scopes,
+		time.Duration(input.ExpiresInDays)*24*time.Hour,
+	)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": key,
+		"key":     plaintext,
+	})
+}
+
+// GetAPIKeys lists the user's active keys
+func (ac *APIKeyController) GetAPIKeys(c *gin.Context) {
+	keys, err := ac.apiKeyService.ListAPIKeys(c.GetUint("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// RevokeAPIKey revokes one of the user's keys
+func (ac *APIKeyController) RevokeAPIKey(c *gin.Context) {
+	keyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	if err := ac.apiKeyService.RevokeAPIKey(c.GetUint("userID"), uint(keyID)); err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "api key not found" {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
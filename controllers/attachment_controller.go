@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"errors"
+	"mime"
+	"my-ecomm/services"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartOverhead leaves room for the multipart framing around the file
+const multipartOverhead = 1 << 20
+
+type AttachmentController struct {
+	attachmentService *services.AttachmentService
+}
+
+func NewAttachmentController() *AttachmentController {
+	return &AttachmentController{
+		attachmentService: services.NewAttachmentService(),
+	}
+}
+
+// UploadAttachment stores the multipart "file" field for the room. The
+// returned ID is then sent with a message in attachment_ids.
+func (ac *AttachmentController) UploadAttachment(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	maxSize := ac.attachmentService.MaxSize()
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+multipartOverhead)
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large", "max_size": maxSize})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+
+	attachment, err := ac.attachmentService.Upload(uint(roomID), c.GetUint("userID"), header)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "access denied":
+			status = http.StatusForbidden
+		case "file is empty":
+			status = http.StatusBadRequest
+		case "file too large":
+			status = http.StatusRequestEntityTooLarge
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"attachment": attachment})
+}
+
+// DownloadAttachment streams an attachment to a member of its room
+func (ac *AttachmentController) DownloadAttachment(c *gin.Context) {
+	ac.download(c, false)
+}
+
+// DownloadThumbnail streams the thumbnail of an image attachment
+func (ac *AttachmentController) DownloadThumbnail(c *gin.Context) {
+	ac.download(c, true)
+}
+
+func (ac *AttachmentController) download(c *gin.Context, thumbnail bool) {
+	attachmentID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+		return
+	}
+
+	attachment, err := ac.attachmentService.GetAttachment(uint(attachmentID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(attachmentErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	body, err := ac.attachmentService.Open(attachment, thumbnail)
+	if err != nil {
+		c.JSON(attachmentErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	contentType, size := attachment.ContentType, attachment.Size
+	if thumbnail {
+		contentType, size = "image/png", -1
+	}
+
+	// Only images are shown inline, anything else could run script in our origin
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") && contentType != "image/svg+xml" {
+		disposition = "inline"
+	}
+
+	c.DataFromReader(http.StatusOK, size, contentType, body, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=3600",
+	})
+}
+
+func attachmentErrorStatus(err error) int {
+	switch err.Error() {
+	case "attachment not found":
+		return http.StatusNotFound
+	case "access denied":
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -1,31 +1,79 @@
 package controllers
 
 import (
+	"crypto/subtle"
+	"errors"
+	"math"
 	"my-ecomm/services"
+	"my-ecomm/utils"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
+// oidcStateCookie holds the hash of the state of the login the browser
+// started, so a callback URL only completes in that browser
+const oidcStateCookie = "oidc_state"
+
 type AuthController struct {
 	authService *services.AuthService
+	mfaService  *services.MFAService
+	oidcService *services.OIDCService
 }
 
 func NewAuthController() *AuthController {
 	return &AuthController{
 		authService: services.NewAuthService(),
+		mfaService:  services.NewMFAService(),
+		oidcService: services.GetOIDCService(),
 	}
 }
 
 type RegisterInput struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
-	Name     string `json:"name" binding:"required"`
+	Email      string `json:"email" binding:"required,email"`
+	Password   string `json:"password" binding:"required,min=6"`
+	Name       string `json:"name" binding:"required"`
+	Username   string `json:"username"` // optional, derived from the email when empty
+	DeviceName string `json:"device_name"`
 }
 
 type LoginInput struct {
-	Email    string `json:"email" binding:"required,email"`
+	Email      string `json:"email" binding:"required,email"`
+	Password   string `json:"password" binding:"required"`
+	DeviceName string `json:"device_name"`
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type ForgotPasswordInput struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordInput struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+type VerifyEmailInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type MFAVerifyInput struct {
+	MFAToken   string `json:"mfa_token" binding:"required"`
+	Code       string `json:"code" binding:"required"`
+	DeviceName string `json:"device_name"`
+}
+
+type MFACodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MFADisableInput struct {
 	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
 }
 
 func (ctrl *AuthController) Register(c *gin.Context) {
@@ -34,14 +82,16 @@ func (ctrl *AuthController) Register(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	user, token, err := ctrl.authService.Register(input.Email, input.Password, input.Name)
+	user, tokens, err := ctrl.authService.Register(input.Email, input.Password, input.Name, input.Username, deviceInfo(c, input.DeviceName))
 	if err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusCreated, gin.H{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
 
@@ -51,13 +101,297 @@ func (ctrl *AuthController) Login(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	user, token, err := ctrl.authService.Login(input.Email, input.Password)
+	result, err := ctrl.authService.Login(input.Email, input.Password, deviceInfo(c, input.DeviceName))
+	if err != nil {
+		var locked *services.LoginLockedError
+		switch {
+		case errors.As(err, &locked):
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		case err.Error() == "account is banned":
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(400, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	respondLogin(c, result)
+}
+
+// OIDCStart redirects the user to the identity provider
+func (ctrl *AuthController) OIDCStart(c *gin.Context) {
+	authURL, state, err := ctrl.oidcService.AuthorizationURL(c.Param("provider"))
+	if err != nil {
+		status := http.StatusBadGateway
+		if err.Error() == "unknown provider" {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	// Lax so the cookie comes along on the provider's redirect back
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, utils.HashToken(state), int(services.OIDCStateTTL.Seconds()), "/", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback completes the provider login and responds like Login
+func (ctrl *AuthController) OIDCCallback(c *gin.Context) {
+	if providerError := c.Query("error"); providerError != "" {
+		c.JSON(400, gin.H{"error": providerError})
+		return
+	}
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		c.JSON(400, gin.H{"error": "missing code or state"})
+		return
+	}
+	// The state must belong to the login this browser started
+	stateHash, _ := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	if subtle.ConstantTimeCompare([]byte(stateHash), []byte(utils.HashToken(state))) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired state"})
+		return
+	}
+
+	result, err := ctrl.oidcService.Login(c.Param("provider"), code, state, deviceInfo(c, ""))
+	if err != nil {
+		status := http.StatusUnauthorized
+		if err.Error() == "unknown provider" {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	respondLogin(c, result)
+}
+
+// respondLogin writes the {user, token} response shared by every login method
+func respondLogin(c *gin.Context, result *services.LoginResult) {
+	// Second step required: exchange mfa_token with a code at /auth/mfa/verify
+	if result.MFAToken != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    result.MFAToken,
+		})
+		return
+	}
+	// Let the route mark the user online
+	c.Set("userID", result.User.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"user":          result.User,
+		"token":         result.Tokens.AccessToken,
+		"refresh_token": result.Tokens.RefreshToken,
+		"expires_in":    result.Tokens.ExpiresIn,
+	})
+}
+
+// VerifyMFA completes a login by exchanging the mfa_token and a TOTP or recovery code
+func (ctrl *AuthController) VerifyMFA(c *gin.Context) {
+	var input MFAVerifyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	user, tokens, err := ctrl.mfaService.VerifyLogin(input.MFAToken, input.Code, deviceInfo(c, input.DeviceName))
+	if err != nil {
+		var locked *services.LoginLockedError
+		if errors.As(err, &locked) {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set("userID", user.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// SetupMFA starts TOTP enrollment and returns the secret and provisioning URI for the QR code
+func (ctrl *AuthController) SetupMFA(c *gin.Context) {
+	secret, uri, err := ctrl.mfaService.SetupTOTP(c.GetUint("userID"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "mfa already enabled" {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": uri,
+	})
+}
+
+// EnableMFA confirms enrollment with a first code and returns the recovery codes
+func (ctrl *AuthController) EnableMFA(c *gin.Context) {
+	var input MFACodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	codes, err := ctrl.mfaService.EnableTOTP(c.GetUint("userID"), input.Code)
 	if err != nil {
+		status := http.StatusBadRequest
+		if err.Error() == "failed to enable mfa" {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns two-factor authentication off
+func (ctrl *AuthController) DisableMFA(c *gin.Context) {
+	var input MFADisableInput
+	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	if err := ctrl.mfaService.DisableTOTP(c.GetUint("userID"), input.Password, input.Code); err != nil {
+		status := http.StatusBadRequest
+		if err.Error() == "failed to disable mfa" {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// Refresh rotates the refresh token and issues a new access token
+func (ctrl *AuthController) Refresh(c *gin.Context) {
+	var input RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	tokens, err := ctrl.authService.Refresh(input.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"user":  user,
-		"token": token,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
+
+// Logout revokes the current session so its tokens stop working immediately
+func (ctrl *AuthController) Logout(c *gin.Context) {
+	if err := ctrl.authService.Logout(c.GetUint("sessionID")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// GetSessions lists every device the user is logged in on
+func (ctrl *AuthController) GetSessions(c *gin.Context) {
+	sessions, err := ctrl.authService.GetSessions(c.GetUint("userID"), c.GetUint("sessionID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeSession signs out one device and closes its WebSocket connections
+func (ctrl *AuthController) RevokeSession(c *gin.Context) {
+	sessionID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	if err := ctrl.authService.RevokeSession(c.GetUint("userID"), uint(sessionID)); err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "session not found" {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
+
+// ForgotPassword emails a password reset link if the account exists
+func (ctrl *AuthController) ForgotPassword(c *gin.Context) {
+	var input ForgotPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ctrl.authService.RequestPasswordReset(input.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "If an account exists for this email, a reset link has been sent"})
+}
+
+// ResetPassword sets a new password using a reset token
+func (ctrl *AuthController) ResetPassword(c *gin.Context) {
+	var input ResetPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ctrl.authService.ResetPassword(input.Token, input.Password); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
+
+// VerifyEmail confirms the user's email address using a verification token
+func (ctrl *AuthController) VerifyEmail(c *gin.Context) {
+	var input VerifyEmailInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ctrl.authService.VerifyEmail(input.Token); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ResendVerificationEmail sends a new verification link to the logged-in user
+func (ctrl *AuthController) ResendVerificationEmail(c *gin.Context) {
+	if err := ctrl.authService.ResendVerificationEmail(c.GetUint("userID")); err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "email already verified" {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// JWKS publishes the public keys so other services can verify access tokens
+func (ctrl *AuthController) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": utils.JWKS()})
+}
+
+func deviceInfo(c *gin.Context, deviceName string) services.DeviceInfo {
+	return services.DeviceInfo{
+		Name:      deviceName,
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+}
@@ -2,13 +2,14 @@
 package controllers
 
 import (
-	"encoding/json"
 	"log"
 	"my-ecomm/config"
+	"my-ecomm/middleware"
 	"my-ecomm/models"
 	"my-ecomm/services"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -42,6 +43,13 @@ type CreateRoomRequest struct {
 type UpdateRoomRequest struct {
 	Name        *string `json:"name"`
 	Description *string `json:"description"`
+	Topic       *string `json:"topic" binding:"omitempty,max=250"`
+	AvatarURL   *string `json:"avatar_url" binding:"omitempty,max=2048"`
+	Settings    *struct {
+		PostPolicy      *string `json:"post_policy"`
+		AddMemberPolicy *string `json:"add_member_policy"`
+		SlowModeSeconds *int    `json:"slow_mode_seconds"`
+	} `json:"settings"`
 }
 
 type UpdateMessageRequest struct {
@@ -52,6 +60,39 @@ type CreateDirectChatRequest struct {
 	UserID uint `json:"user_id" binding:"required"`
 }
 
+// SendMessageRequest needs content, attachments or both
+type SendMessageRequest struct {
+	Content       string `json:"content"`
+	ParentID      *uint  `json:"parent_id"`
+	AttachmentIDs []uint `json:"attachment_ids"`
+}
+
+type MarkReadRequest struct {
+	MessageID uint `json:"message_id"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji" binding:"required"`
+}
+
+type MemberRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+// CreateInviteRequest limits a new invite, zero values mean no limit
+type CreateInviteRequest struct {
+	ExpiresInSeconds int `json:"expires_in_seconds"`
+	MaxUses          int `json:"max_uses"`
+}
+
+type WSTicketRequest struct {
+	RoomID uint `json:"room_id" binding:"required"`
+}
+
 // CreateRoom creates a new group chat room
 func (cc *ChatController) CreateRoom(c *gin.Context) {
 	var req CreateRoomRequest
@@ -92,6 +133,11 @@ func (cc *ChatController) CreateRoom(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add creator"})
 		return
 	}
+	if isGroup {
+		config.DB.Model(&models.RoomMember{}).
+			Where("room_id = ? AND user_id = ?", room.ID, userID).
+			Update("role", models.RoomRoleOwner)
+	}
 
 	// Add additional members
 	if len(req.MemberIDs) > 0 {
@@ -116,7 +162,7 @@ func (cc *ChatController) CreateRoom(c *gin.Context) {
 	})
 }
 
-// UpdateRoom updates a chat room's name and/or description
+// UpdateRoom updates a chat room's details and settings
 func (cc *ChatController) UpdateRoom(c *gin.Context) {
 	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
@@ -132,15 +178,28 @@ func (cc *ChatController) UpdateRoom(c *gin.Context) {
 
 	userID := c.GetUint("userID")
 
+	update := services.RoomUpdate{
+		Name:        req.Name,
+		Description: req.Description,
+		Topic:       req.Topic,
+		AvatarURL:   req.AvatarURL,
+	}
+	if req.Settings != nil {
+		update.PostPolicy = req.Settings.PostPolicy
+		update.AddMemberPolicy = req.Settings.AddMemberPolicy
+		update.SlowModeSeconds = req.Settings.SlowModeSeconds
+	}
+
 	// Use service to update room
-	room, err := cc.chatService.UpdateRoom(uint(roomID), userID, req.Name, req.Description)
+	room, err := cc.chatService.UpdateRoom(uint(roomID), userID, update)
 	if err != nil {
 		status := http.StatusInternalServerError
-		if err.Error() == "room not found" {
+		switch err.Error() {
+		case "room not found":
 			status = http.StatusNotFound
-		} else if err.Error() == "access denied" || err.Error() == "cannot update direct chat" {
+		case "access denied", "cannot update direct chat":
 			status = http.StatusForbidden
-		} else if err.Error() == "no fields to update" {
+		case "no fields to update", "invalid avatar url", "invalid policy", "invalid slow mode interval":
 			status = http.StatusBadRequest
 		}
 		c.JSON(status, gin.H{"error": err.Error()})
@@ -175,8 +234,10 @@ func (cc *ChatController) UpdateMessage(c *gin.Context) {
 		status := http.StatusInternalServerError
 		if err.Error() == "message not found" {
 			status = http.StatusNotFound
-		} else if err.Error() == "only sender can update the message" {
+		} else if err.Error() == "only sender can update the message" || err.Error() == "access denied" {
 			status = http.StatusForbidden
+		} else if err.Error() == "message content is required" {
+			status = http.StatusBadRequest
 		}
 		c.JSON(status, gin.H{"error": err.Error()})
 		return
@@ -204,7 +265,7 @@ func (cc *ChatController) DeleteMessage(c *gin.Context) {
 		status := http.StatusInternalServerError
 		if err.Error() == "message not found" {
 			status = http.StatusNotFound
-		} else if err.Error() == "only sender can delete the message" {
+		} else if err.Error() == "only sender can delete the message" || err.Error() == "access denied" {
 			status = http.StatusForbidden
 		}
 		c.JSON(status, gin.H{"error": err.Error()})
@@ -214,55 +275,193 @@ func (cc *ChatController) DeleteMessage(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Message deleted successfully"})
 }
 
-// GetUserRooms retrieves all rooms for the authenticated user
-func (cc *ChatController) GetUserRooms(c *gin.Context) {
-	userID := c.GetUint("userID")
+// GetMessageEdits returns the edit history of a message
+func (cc *ChatController) GetMessageEdits(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	edits, err := cc.chatService.GetMessageEdits(uint(messageID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
 
-	var roomIDs []uint
-	err := config.DB.Table("room_members").
-		Select("room_id").
-		Where("user_id = ?", userID).
-		Pluck("room_id", &roomIDs).Error
+	c.JSON(http.StatusOK, gin.H{"edits": edits})
+}
 
+// AddReaction reacts to a message with an emoji
+func (cc *ChatController) AddReaction(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
 		return
 	}
 
-	if len(roomIDs) == 0 {
-		c.JSON(http.StatusOK, gin.H{"rooms": []models.ChatRoom{}})
+	var req ReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get rooms by IDs
-	var rooms []models.ChatRoom
-	err = config.DB.
-		Where("id IN ?", roomIDs).
-		Preload("Members").
-		Preload("Creator").
-		Order("updated_at DESC").
-		Find(&rooms).Error
+	reaction, err := cc.chatService.AddReaction(uint(messageID), c.GetUint("userID"), req.Emoji)
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"reaction": reaction})
+}
 
+// RemoveReaction takes back the user's emoji, given URL-encoded in the path
+func (cc *ChatController) RemoveReaction(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	if err := cc.chatService.RemoveReaction(uint(messageID), c.GetUint("userID"), c.Param("emoji")); err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction removed"})
+}
+
+// PinMessage pins a message to its room, for room admins
+func (cc *ChatController) PinMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	pin, err := cc.chatService.PinMessage(uint(messageID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"pin": pin})
+}
+
+// UnpinMessage removes a message from the room's pins, for room admins
+func (cc *ChatController) UnpinMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	if err := cc.chatService.UnpinMessage(uint(messageID), c.GetUint("userID")); err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message unpinned"})
+}
+
+// GetPinnedMessages lists the pinned messages of a room
+func (cc *ChatController) GetPinnedMessages(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	pins, err := cc.chatService.GetPinnedMessages(uint(roomID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pins": pins})
+}
+
+// StarMessage bookmarks a message for the caller
+func (cc *ChatController) StarMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	star, err := cc.chatService.StarMessage(uint(messageID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	// Load last message for each room
-	for i := range rooms {
-		var lastMessage models.Message
-		if err := config.DB.Where("room_id = ?", rooms[i].ID).
-			Order("created_at DESC").
-			Limit(1).
-			Preload("Sender").
-			First(&lastMessage).Error; err == nil {
-			rooms[i].Messages = []models.Message{lastMessage}
+	c.JSON(http.StatusCreated, gin.H{"star": star})
+}
+
+// UnstarMessage removes the caller's bookmark
+func (cc *ChatController) UnstarMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	if err := cc.chatService.UnstarMessage(uint(messageID), c.GetUint("userID")); err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message unstarred"})
+}
+
+// GetStarredMessages lists the caller's bookmarks, paged with before and limit
+func (cc *ChatController) GetStarredMessages(c *gin.Context) {
+	var before uint64
+	if value := c.Query("before"); value != "" {
+		var err error
+		if before, err = strconv.ParseUint(value, 10, 32); err != nil || before == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before cursor"})
+			return
 		}
 	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	stars, hasMore, err := cc.chatService.GetStarredMessages(c.GetUint("userID"), uint(before), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var nextCursor *uint
+	if hasMore {
+		nextCursor = &stars[len(stars)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"starred": stars, "next_cursor": nextCursor, "has_more": hasMore})
+}
+
+// GetUserRooms retrieves all rooms for the authenticated user with their
+// last message, unread and mention counts
+func (cc *ChatController) GetUserRooms(c *gin.Context) {
+	rooms, err := cc.chatService.GetRoomSummaries(c.GetUint("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"rooms": rooms})
 }
 
+// GetUnreadTotals returns the total unread badge across all rooms
+func (cc *ChatController) GetUnreadTotals(c *gin.Context) {
+	totals, err := cc.chatService.GetUnreadTotals(c.GetUint("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, totals)
+}
+
 // GetRoomByID retrieves a specific room by ID
 func (cc *ChatController) GetRoomByID(c *gin.Context) {
 	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
@@ -301,7 +500,7 @@ func (cc *ChatController) GetRoomByID(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"room": room})
 }
 
-// AddMemberToRoom adds a user to a room
+// AddMemberToRoom adds a user to a group room, for room admins
 func (cc *ChatController) AddMemberToRoom(c *gin.Context) {
 	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
@@ -317,173 +516,393 @@ func (cc *ChatController) AddMemberToRoom(c *gin.Context) {
 		return
 	}
 
-	currentUserID := c.GetUint("userID")
+	if err := cc.chatService.AddMemberToRoom(uint(roomID), c.GetUint("userID"), req.UserID); err != nil {
+		c.JSON(memberErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
 
-	var room models.ChatRoom
-	if err := config.DB.Preload("Members").First(&room, roomID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+	c.JSON(http.StatusOK, gin.H{"message": "Member added successfully"})
+}
+
+// GetRoomMembers lists the members of a room with their roles
+func (cc *ChatController) GetRoomMembers(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
 		return
 	}
 
-	// Only allow adding members to group chats
-	if !room.IsGroup {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot add members to direct chats"})
+	members, err := cc.chatService.GetRoomMembers(uint(roomID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(memberErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if current user is a member
-	var isMember bool
-	for _, member := range room.Members {
-		if member.ID == currentUserID {
-			isMember = true
-			break
-		}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// RemoveMember removes another member from a group room
+func (cc *ChatController) RemoveMember(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+	memberID, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
 	}
 
-	if !isMember {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+	if err := cc.chatService.RemoveMember(uint(roomID), c.GetUint("userID"), uint(memberID)); err != nil {
+		c.JSON(memberErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	var newMember models.User
-	if err := config.DB.First(&newMember, req.UserID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// LeaveRoom removes the caller from a group room
+func (cc *ChatController) LeaveRoom(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
 		return
 	}
 
-	if err := config.DB.Model(&room).Association("Members").Append(&newMember); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member"})
+	if err := cc.chatService.LeaveRoom(uint(roomID), c.GetUint("userID")); err != nil {
+		c.JSON(memberErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Member added successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Left room"})
 }
 
-// GetRoomMessages retrieves messages for a room
-func (cc *ChatController) GetRoomMessages(c *gin.Context) {
+// SetMemberRole promotes a member to admin or demotes an admin, for the owner
+func (cc *ChatController) SetMemberRole(c *gin.Context) {
 	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
 		return
 	}
+	memberID, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
 
-	userID := c.GetUint("userID")
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
-	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	var req MemberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// Check if user is a member
-	var room models.ChatRoom
-	if err := config.DB.Preload("Members").First(&room, roomID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+	if err := cc.chatService.SetMemberRole(uint(roomID), c.GetUint("userID"), uint(memberID), req.Role); err != nil {
+		c.JSON(memberErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	var isMember bool
-	for _, member := range room.Members {
-		if member.ID == userID {
-			isMember = true
-			break
-		}
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
+}
+
+// TransferOwnership hands the room over to another member, for the owner
+func (cc *ChatController) TransferOwnership(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
 	}
 
-	if !isMember {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+	var req TransferOwnershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var messages []models.Message
-	err = config.DB.
-		Where("room_id = ?", roomID).
-		Preload("Sender").
-		Order("created_at DESC").
-		Limit(limit).
-		Offset(offset).
-		Find(&messages).Error
+	if err := cc.chatService.TransferOwnership(uint(roomID), c.GetUint("userID"), req.UserID); err != nil {
+		c.JSON(memberErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Ownership transferred"})
+}
 
+// CreateInvite creates a shareable invite link to a group room
+func (cc *ChatController) CreateInvite(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"messages": messages})
+	var req CreateInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invite, err := cc.chatService.CreateInvite(uint(roomID), c.GetUint("userID"), services.InviteOptions{
+		ExpiresIn: time.Duration(req.ExpiresInSeconds) * time.Second,
+		MaxUses:   req.MaxUses,
+	})
+	if err != nil {
+		c.JSON(inviteErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invite": invite})
 }
 
-// SendMessage sends a message to a room
-func (cc *ChatController) SendMessage(c *gin.Context) {
+// GetRoomInvites lists a room's invites and who joined through them, for room admins
+func (cc *ChatController) GetRoomInvites(c *gin.Context) {
 	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
 		return
 	}
 
-	var req struct {
-		Content string `json:"content" binding:"required"`
+	invites, err := cc.chatService.GetRoomInvites(uint(roomID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(inviteErrorStatus(err), gin.H{"error": err.Error()})
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+
+	c.JSON(http.StatusOK, gin.H{"invites": invites})
+}
+
+// RevokeInvite disables an invite link
+func (cc *ChatController) RevokeInvite(c *gin.Context) {
+	if err := cc.chatService.RevokeInvite(c.Param("code"), c.GetUint("userID")); err != nil {
+		c.JSON(inviteErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	userID := c.GetUint("userID")
+	c.JSON(http.StatusOK, gin.H{"message": "Invite revoked"})
+}
 
-	// Check if user is a member
-	var room models.ChatRoom
-	if err := config.DB.Preload("Members").First(&room, roomID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+// PreviewInvite shows the room an invite link leads to
+func (cc *ChatController) PreviewInvite(c *gin.Context) {
+	preview, err := cc.chatService.PreviewInvite(c.Param("code"), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(inviteErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	var isMember bool
-	for _, member := range room.Members {
-		if member.ID == userID {
-			isMember = true
-			break
-		}
+	c.JSON(http.StatusOK, gin.H{"invite": preview})
+}
+
+// JoinWithInvite adds the caller to the room of an invite link
+func (cc *ChatController) JoinWithInvite(c *gin.Context) {
+	room, err := cc.chatService.JoinWithInvite(c.Param("code"), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(inviteErrorStatus(err), gin.H{"error": err.Error()})
+		return
 	}
 
-	if !isMember {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+func inviteErrorStatus(err error) int {
+	switch err.Error() {
+	case "room not found", "invite not found":
+		return http.StatusNotFound
+	case "access denied":
+		return http.StatusForbidden
+	case "invite expired":
+		return http.StatusGone
+	case "cannot manage members of a direct chat", "invalid invite options":
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func memberErrorStatus(err error) int {
+	switch err.Error() {
+	case "room not found", "user not found", "user is not a member":
+		return http.StatusNotFound
+	case "access denied":
+		return http.StatusForbidden
+	case "user is already a member":
+		return http.StatusConflict
+	case "cannot manage members of a direct chat", "use leave to remove yourself",
+		"owner must transfer ownership before leaving", "invalid role":
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetRoomMessages retrieves a page of messages for a room. Pages are
+// selected with ?before=, ?after= or ?around= a message ID.
+func (cc *ChatController) GetRoomMessages(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
 		return
 	}
 
-	message := models.Message{
-		RoomID:   uint(roomID),
-		SenderID: userID,
-		Content:  req.Content,
+	var query services.MessageQuery
+	cursors := 0
+	for name, target := range map[string]*uint{"before": &query.Before, "after": &query.After, "around": &query.Around} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || id == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " cursor"})
+			return
+		}
+		*target = uint(id)
+		cursors++
+	}
+	if cursors > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use only one of before, after and around"})
+		return
 	}
+	query.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	query.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
 
-	if err := config.DB.Create(&message).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+	page, err := cc.chatService.GetRoomMessages(uint(roomID), c.GetUint("userID"), query)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "room not found":
+			status = http.StatusNotFound
+		case "access denied":
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
-	config.DB.Preload("Sender").First(&message, message.ID)
+	c.JSON(http.StatusOK, page)
+}
 
-	// Update room's updated_at
-	config.DB.Model(&room).Update("updated_at", message.CreatedAt)
+// SearchMessages searches the caller's rooms. Besides q it accepts room_id,
+// sender_id, from and to (RFC 3339 or YYYY-MM-DD, to is inclusive),
+// before (cursor) and limit.
+func (cc *ChatController) SearchMessages(c *gin.Context) {
+	query := services.SearchQuery{Text: c.Query("q")}
 
-	// Broadcast message to WebSocket clients (non-blocking)
-	go func() {
-		wsResponse := map[string]interface{}{
-			"type":    "message",
-			"message": message,
+	for name, target := range map[string]*uint{"room_id": &query.RoomID, "sender_id": &query.SenderID, "before": &query.Before} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || id == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+			return
 		}
+		*target = uint(id)
+	}
 
-		if data, err := json.Marshal(wsResponse); err == nil {
-			hub := services.GetHub()
-			select {
-			case hub.Broadcast <- &services.BroadcastMessage{
-				RoomID:  uint(roomID),
-				Message: data,
-			}:
-				log.Printf("Broadcasted REST message %d to room %d", message.ID, roomID)
-			default:
-				log.Printf("Failed to broadcast message %d to room %d (channel full)", message.ID, roomID)
+	for name, target := range map[string]**time.Time{"from": &query.From, "to": &query.To} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			day, dayErr := time.Parse("2006-01-02", value)
+			if dayErr != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " date"})
+				return
+			}
+			// A bare end date includes that whole day
+			if name == "to" {
+				day = day.AddDate(0, 0, 1)
 			}
-		} else {
-			log.Printf("Failed to marshal WebSocket response: %v", err)
+			t = day
+		}
+		// created_at is stored in the server's zone and compared as text
+		t = t.In(time.Local)
+		*target = &t
+	}
+	query.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	page, err := cc.chatService.SearchMessages(c.GetUint("userID"), query)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "search query is required":
+			status = http.StatusBadRequest
+		case "access denied":
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// GetMentions returns the caller's unread mentions, newest first. all=true
+// includes those already read; room_id, before (cursor) and limit narrow the page.
+func (cc *ChatController) GetMentions(c *gin.Context) {
+	query := services.MentionQuery{All: c.Query("all") == "true"}
+
+	for name, target := range map[string]*uint{"room_id": &query.RoomID, "before": &query.Before} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || id == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+			return
+		}
+		*target = uint(id)
+	}
+	query.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	page, err := cc.chatService.GetMentions(c.GetUint("userID"), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// SendMessage sends a message to a room, or a reply when parent_id is set
+func (cc *ChatController) SendMessage(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req SendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, err := cc.chatService.SendMessage(services.SendMessageParams{
+		RoomID:        uint(roomID),
+		SenderID:      c.GetUint("userID"),
+		Content:       req.Content,
+		ParentID:      req.ParentID,
+		AttachmentIDs: req.AttachmentIDs,
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "user is not a member of this room", "only admins can post in this room":
+			status = http.StatusForbidden
+		case "slow mode is on, wait before sending":
+			status = http.StatusTooManyRequests
+		case "room not found", "parent message not found":
+			status = http.StatusNotFound
+		case "message content is required", "too many attachments", "invalid attachment":
+			status = http.StatusBadRequest
 		}
-	}()
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Message sent successfully",
@@ -491,6 +910,29 @@ func (cc *ChatController) SendMessage(c *gin.Context) {
 	})
 }
 
+// GetThread returns a message with its thread replies and participants
+func (cc *ChatController) GetThread(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+	after, _ := strconv.ParseUint(c.DefaultQuery("after", "0"), 10, 32)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	thread, err := cc.chatService.GetThread(uint(messageID), c.GetUint("userID"), uint(after), limit)
+	if err != nil {
+		status := messageErrorStatus(err)
+		if err.Error() == "message is a reply" {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, thread)
+}
+
 // MarkMessageAsRead marks a message as read
 func (cc *ChatController) MarkMessageAsRead(c *gin.Context) {
 	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
@@ -499,19 +941,101 @@ func (cc *ChatController) MarkMessageAsRead(c *gin.Context) {
 		return
 	}
 
-	var message models.Message
-	if err := config.DB.First(&message, messageID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	receipt, err := cc.chatService.MarkMessageAsRead(uint(messageID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	message.IsRead = true
-	if err := config.DB.Save(&message).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark message as read"})
+	c.JSON(http.StatusOK, gin.H{"message": "Message marked as read", "receipt": receipt})
+}
+
+// MarkRoomRead moves the user's read cursor up to message_id, or to the
+// latest message of the room when it is omitted
+func (cc *ChatController) MarkRoomRead(c *gin.Context) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return
+	}
+
+	var req MarkReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	receipt, err := cc.chatService.MarkRoomRead(uint(roomID), c.GetUint("userID"), req.MessageID)
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"receipt": receipt})
+}
+
+// GetMessageSeenBy lists the members who have read a message
+func (cc *ChatController) GetMessageSeenBy(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	users, err := cc.chatService.GetSeenBy(uint(messageID), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(messageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"seen_by": users})
+}
+
+func messageErrorStatus(err error) int {
+	switch err.Error() {
+	case "message not found", "reaction not found", "message not pinned", "message not starred":
+		return http.StatusNotFound
+	case "access denied":
+		return http.StatusForbidden
+	case "emoji is required", "invalid emoji", "too many pinned messages":
+		return http.StatusBadRequest
+	case "too many reactions":
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// CreateWSTicket issues a one-time ticket to open the room's WebSocket with
+// /chat/rooms/:id/ws?ticket=..., so no long-lived token ends up in URLs
+func (cc *ChatController) CreateWSTicket(c *gin.Context) {
+	var req WSTicketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ticket, expiresAt, err := services.GetWSTicketService().IssueTicket(services.WSTicket{
+		UserID:     c.GetUint("userID"),
+		RoomID:     req.RoomID,
+		SessionID:  c.GetUint("sessionID"),
+		APIKeyID:   c.GetUint("apiKeyID"),
+		AuthMethod: c.GetString("authMethod"),
+		Scopes:     c.GetStringSlice("scopes"),
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "access denied" {
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message marked as read"})
+	c.JSON(http.StatusOK, gin.H{
+		"ticket":     ticket,
+		"expires_at": expiresAt,
+	})
 }
 
 // HandleWebSocket handles WebSocket connections
@@ -530,6 +1054,12 @@ func (cc *ChatController) HandleWebSocket(c *gin.Context) {
 		return
 	}
 
+	// The ticket may predate a removal from the room
+	if !cc.chatService.IsRoomMember(uint(roomID), userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+		return
+	}
+
 	conn, err := cc.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println("WebSocket upgrade error:", err)
@@ -539,12 +1069,15 @@ func (cc *ChatController) HandleWebSocket(c *gin.Context) {
 	log.Printf("User joined: ID=%d, Name=%s, RoomID=%d\n", user.ID, user.Name, roomID)
 
 	client := &services.Client{
-		ID:       user.ID,
-		Username: user.Name,
-		RoomID:   uint(roomID),
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		Hub:      services.GetHub(),
+		ID:        user.ID,
+		Username:  user.Name,
+		RoomID:    uint(roomID),
+		SessionID: c.GetUint("sessionID"),
+		APIKeyID:  c.GetUint("apiKeyID"),
+		ReadOnly:  !middleware.HasScope(c, models.ScopeChatWrite),
+		Conn:      conn,
+		Send:      make(chan []byte, 256),
+		Hub:       services.GetHub(),
 	}
 
 	client.Hub.Register <- client
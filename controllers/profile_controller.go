@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"my-ecomm/services"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ProfileController struct {
+	profileService *services.ProfileService
+	accountService *services.AccountService
+}
+
+func NewProfileController() *ProfileController {
+	return &ProfileController{
+		profileService: services.NewProfileService(),
+		accountService: services.NewAccountService(),
+	}
+}
+
+type UpdateProfileInput struct {
+	Name      *string `json:"name" binding:"omitempty,max=100"`
+	Username  *string `json:"username"`
+	AvatarURL *string `json:"avatar_url" binding:"omitempty,max=2048"`
+}
+
+type DeleteAccountInput struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+// GetMe returns the authenticated user's profile
+func (pc *ProfileController) GetMe(c *gin.Context) {
+	user, err := pc.profileService.GetProfile(c.GetUint("userID"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// UpdateMe changes the name, username or avatar of the authenticated user
+func (pc *ProfileController) UpdateMe(c *gin.Context) {
+	var input UpdateProfileInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := pc.profileService.UpdateProfile(c.GetUint("userID"), services.ProfileUpdate{
+		Name:      input.Name,
+		Username:  input.Username,
+		AvatarURL: input.AvatarURL,
+	})
+	if err != nil {
+		status := http.StatusBadRequest
+		switch err.Error() {
+		case "user not found":
+			status = http.StatusNotFound
+		case "username already taken":
+			status = http.StatusConflict
+		case "failed to update profile":
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// ChangePassword sets a new password and signs out the user's other devices
+func (pc *ProfileController) ChangePassword(c *gin.Context) {
+	var input ChangePasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := pc.profileService.ChangePassword(c.GetUint("userID"), c.GetUint("sessionID"), input.CurrentPassword, input.NewPassword)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "invalid password" {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed, other sessions were signed out"})
+}
+
+// DeleteMe deletes the authenticated user's account. The data is anonymized
+// once the grace period is over.
+func (pc *ProfileController) DeleteMe(c *gin.Context) {
+	var input DeleteAccountInput
+	if err := c.ShouldBindJSON(&input); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	purgeAfter, err := pc.accountService.DeleteAccount(c.GetUint("userID"), c.GetUint("sessionID"), input.Password, input.Code)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "invalid password", "invalid code":
+			status = http.StatusBadRequest
+		case "recent login required":
+			status = http.StatusForbidden
+		case "user not found":
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Account deleted",
+		"purge_after": purgeAfter,
+	})
+}
+
+// ExportMe downloads a ZIP archive of the authenticated user's data
+func (pc *ProfileController) ExportMe(c *gin.Context) {
+	filename := fmt.Sprintf("export-%d-%s.zip", c.GetUint("userID"), time.Now().Format("20060102"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if err := pc.accountService.ExportData(c.GetUint("userID"), c.Writer); err != nil {
+		log.Printf("Failed to export data of user %d: %v", c.GetUint("userID"), err)
+		// Nothing useful can be sent once the archive started streaming
+		if !c.Writer.Written() {
+			c.Header("Content-Disposition", "")
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export data"})
+		}
+	}
+}
@@ -22,7 +22,7 @@ func (uc *UserController) GetAllUsers(c *gin.Context) {
 	currentUserID := c.GetUint("userID")
 
 	if err := config.DB.
-		Select("id, name, username, email, is_online, last_seen_at, created_at, updated_at").
+		Select("id, name, username, avatar_url, email, is_online, last_seen_at, created_at, updated_at").
 		Where("id != ?", currentUserID).
 		Find(&users).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
@@ -41,7 +41,7 @@ func (uc *UserController) GetUserByID(c *gin.Context) {
 
 	var user models.User
 	if err := config.DB.
-		Select("id, name, username, email, is_online, last_seen_at, created_at, updated_at").
+		Select("id, name, username, avatar_url, email, is_online, last_seen_at, created_at, updated_at").
 		First(&user, userID).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
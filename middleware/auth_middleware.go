@@ -1,49 +1,85 @@
 package middleware
 
 import (
+	"my-ecomm/services"
 	"my-ecomm/utils"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Values of the "authMethod" context key
+const (
+	AuthMethodSession = "session"
+	AuthMethodAPIKey  = "api_key"
+)
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
-		tokenString := ""
 
-		// 1. If missing Authorization header → try to read ?token=
+		// 1. Tokens are only accepted in the header, never in the URL
 		if authHeader == "" {
-			tokenString = c.Query("token")
-		} else {
-			parts := strings.Split(authHeader, " ")
-			if len(parts) != 2 || parts[0] != "Bearer" {
-				c.JSON(401, gin.H{"error": "Invalid authorization header format"})
-				c.Abort()
-				return
-			}
-			tokenString = parts[1]
-		}
-
-		// 2. Still no token? Reject.
-		if tokenString == "" {
 			c.JSON(401, gin.H{"error": "Authorization header missing"})
 			c.Abort()
 			return
 		}
 
-		// 3. Validate token
-		claims, err := utils.ValidateToken(tokenString)
-		if err != nil {
-			c.JSON(401, gin.H{"error": "Invalid or expired token"})
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || (parts[0] != "Bearer" && parts[0] != "ApiKey") {
+			c.JSON(401, gin.H{"error": "Invalid authorization header format"})
 			c.Abort()
 			return
 		}
 
-		// 4. Save user details in context
-		c.Set("userID", claims.UserID)
-		c.Set("email", claims.Email)
+		// 2. Validate and save user details in context
+		if parts[0] == "ApiKey" {
+			authenticateAPIKey(c, parts[1])
+			return
+		}
+		authenticateBearer(c, parts[1])
+	}
+}
 
-		c.Next()
+// authenticateBearer validates an access token and the session behind it
+func authenticateBearer(c *gin.Context, tokenString string) {
+	claims, err := utils.ValidateToken(tokenString)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired token"})
+		c.Abort()
+		return
 	}
+
+	// Reject tokens whose session was revoked (logout, password change, admin)
+	if !services.NewSessionService().UseSession(claims.SessionID, claims.UserID) {
+		c.JSON(401, gin.H{"error": "Session has been revoked"})
+		c.Abort()
+		return
+	}
+
+	c.Set("userID", claims.UserID)
+	c.Set("email", claims.Email)
+	c.Set("sessionID", claims.SessionID)
+	c.Set("authMethod", AuthMethodSession)
+
+	c.Next()
+}
+
+// authenticateAPIKey handles the "Authorization: ApiKey <key>" scheme. The
+// granted scopes are enforced per route by RequireScope.
+func authenticateAPIKey(c *gin.Context, plaintext string) {
+	key, err := services.NewAPIKeyService().Authenticate(plaintext)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or revoked API key"})
+		c.Abort()
+		return
+	}
+
+	c.Set("userID", key.UserID)
+	c.Set("email", key.User.Email)
+	c.Set("apiKeyID", key.ID)
+	c.Set("scopes", key.Scopes)
+	c.Set("authMethod", AuthMethodAPIKey)
+
+	c.Next()
 }
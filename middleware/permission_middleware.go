@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"my-ecomm/config"
+	"my-ecomm/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission allows the request only if the user's role grants every
+// listed permission. Must run after AuthMiddleware.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read the role on every request so role changes apply immediately
+		var user models.User
+		if err := config.DB.Select("id, role").First(&user, c.GetUint("userID")).Error; err != nil {
+			c.JSON(401, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+
+		for _, permission := range permissions {
+			if !user.Can(permission) {
+				c.JSON(403, gin.H{"error": "Insufficient permissions"})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Set("role", user.Role)
+		c.Next()
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"log"
+	"my-ecomm/services"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WSAuthMiddleware authenticates WebSocket upgrades, which browsers can't send
+// an Authorization header with. It accepts a one-time ticket from
+// POST /chat/ws-ticket in ?ticket=. Access tokens in ?token= are only
+// accepted when WS_ALLOW_QUERY_TOKEN=true, for older clients.
+func WSAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ticket := c.Query("ticket"); ticket != "" {
+			authenticateTicket(c, ticket)
+			return
+		}
+
+		if token := c.Query("token"); token != "" && os.Getenv("WS_ALLOW_QUERY_TOKEN") == "true" {
+			log.Printf("Deprecated ?token= WebSocket authentication used from %s", c.ClientIP())
+			authenticateBearer(c, token)
+			return
+		}
+
+		c.JSON(401, gin.H{"error": "WebSocket ticket missing"})
+		c.Abort()
+	}
+}
+
+func authenticateTicket(c *gin.Context, token string) {
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid room ID"})
+		c.Abort()
+		return
+	}
+
+	ticket, err := services.GetWSTicketService().RedeemTicket(token, uint(roomID))
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired ticket"})
+		c.Abort()
+		return
+	}
+
+	// The credentials may have been revoked since the ticket was issued
+	var active bool
+	if ticket.APIKeyID != 0 {
+		active = services.NewAPIKeyService().IsKeyActive(ticket.APIKeyID)
+	} else {
+		active = services.NewSessionService().UseSession(ticket.SessionID, ticket.UserID)
+	}
+	if !active {
+		c.JSON(401, gin.H{"error": "Session has been revoked"})
+		c.Abort()
+		return
+	}
+
+	c.Set("userID", ticket.UserID)
+	c.Set("sessionID", ticket.SessionID)
+	c.Set("apiKeyID", ticket.APIKeyID)
+	c.Set("scopes", ticket.Scopes)
+	c.Set("authMethod", ticket.AuthMethod)
+
+	c.Next()
+}
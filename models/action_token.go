@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ActionToken records a single-use opaque token (password reset, email
+// verification, pending MFA) by its hash
+type ActionToken struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	TokenHash string     `gorm:"not null;uniqueIndex" json:"-"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	Purpose   string     `gorm:"not null" json:"purpose"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	Attempts  int        `gorm:"default:0" json:"attempts"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
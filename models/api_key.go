@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Scopes an API key can be granted
+const (
+	ScopeChatRead      = "chat:read"
+	ScopeChatWrite     = "chat:write"
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeUsersRead     = "users:read"
+)
+
+// APIScopes lists every scope that can be granted to an API key
+var APIScopes = []string{ScopeChatRead, ScopeChatWrite, ScopeProductsRead, ScopeProductsWrite, ScopeUsersRead}
+
+// APIKey is a long-lived credential for bots and integrations. Only a hash
+// of the key is stored; Prefix identifies it in listings.
+type APIKey struct {
+	gorm.Model
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	User       User       `json:"-" gorm:"foreignKey:UserID"`
+	Name       string     `gorm:"not null" json:"name"`
+	Prefix     string     `gorm:"not null;index" json:"prefix"`
+	KeyHash    string     `gorm:"not null;uniqueIndex" json:"-"`
+	Scopes     []string   `gorm:"serializer:json" json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// IsActive reports whether the key can still be used
+func (k *APIKey) IsActive() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt))
+}
+
+// HasScope reports whether the key was granted scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidScope reports whether scope is a known API key scope
+func IsValidScope(scope string) bool {
+	for _, s := range APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
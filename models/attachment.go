@@ -0,0 +1,33 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Attachment is a file uploaded to a room. It is uploaded first and then
+// sent with a message, which sets MessageID.
+type Attachment struct {
+	ID           uint      `gorm:"primarykey" json:"id"`
+	RoomID       uint      `gorm:"not null;index" json:"room_id"`
+	UploaderID   uint      `gorm:"not null;index" json:"uploader_id"`
+	MessageID    *uint     `gorm:"index" json:"message_id"`
+	FileName     string    `gorm:"not null" json:"file_name"`
+	ContentType  string    `gorm:"not null" json:"content_type"`
+	Size         int64     `gorm:"not null" json:"size"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	StorageKey   string    `gorm:"not null" json:"-"`
+	ThumbnailKey string    `json:"-"`
+	URL          string    `gorm:"-" json:"url"`
+	ThumbnailURL string    `gorm:"-" json:"thumbnail_url,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// SetURLs fills the download URLs, which check room membership on access
+func (a *Attachment) SetURLs() {
+	a.URL = fmt.Sprintf("/api/v1/chat/attachments/%d", a.ID)
+	if a.ThumbnailKey != "" {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+}
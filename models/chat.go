@@ -11,39 +11,115 @@ type ChatRoom struct {
 	gorm.Model
 	Name        string `json:"name" gorm:"not null"`
 	Description string `json:"description"`
+	Topic       string `json:"topic" gorm:"size:250"`
+	AvatarURL   string `json:"avatar_url"`
 	IsGroup     bool   `json:"is_group" gorm:"default:false"`
 	CreatorID   uint   `json:"creator_id" gorm:"not null"`
 	Creator     User   `json:"creator" gorm:"foreignKey:CreatorID"`
 	// CRITICAL FIX: Use joinForeignKey and Reference (not References)
 	Members   []User         `json:"members" gorm:"many2many:room_members;foreignKey:ID;joinForeignKey:RoomID;References:ID;joinReferences:UserID"`
 	Messages  []Message      `json:"messages,omitempty" gorm:"foreignKey:RoomID"`
+	Settings  RoomSettings   `json:"settings" gorm:"embedded;embeddedPrefix:setting_"`
 	CreatedAt time.Time      `json:"CreatedAt"`
 	UpdatedAt time.Time      `json:"UpdatedAt"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+// Room policies: which members may post or add members
+const (
+	RoomPolicyMembers = "members"
+	RoomPolicyAdmins  = "admins"
+)
+
+// RoomSettings are the moderation settings of a group room. Room admins are
+// exempt from slow mode.
+type RoomSettings struct {
+	PostPolicy      string `json:"post_policy" gorm:"size:10;not null;default:members"`
+	AddMemberPolicy string `json:"add_member_policy" gorm:"size:10;not null;default:admins"`
+	SlowModeSeconds int    `json:"slow_mode_seconds" gorm:"not null;default:0"`
+}
+
+// Message types. System messages record room events such as members
+// joining or leaving; they are sent in the name of the member who acted.
+const (
+	MessageTypeText   = "text"
+	MessageTypeSystem = "system"
+)
+
+// Message is a chat message. A message with a ParentID is a reply in the
+// thread of that message, which keeps ReplyCount and LastReplyAt.
+// IsRead and SeenBy are not stored but computed from the members' read
+// cursors: IsRead is true once any member other than the sender has read the
+// message, SeenBy lists those members in group rooms.
 type Message struct {
 	gorm.Model
-	RoomID    uint           `json:"room_id" gorm:"not null;index"`
-	Room      ChatRoom       `json:"-" gorm:"foreignKey:RoomID"`
-	SenderID  uint           `json:"sender_id" gorm:"not null;index"`
-	Sender    User           `json:"sender" gorm:"foreignKey:SenderID"`
-	Content   string         `json:"content" gorm:"type:text;not null"`
-	IsRead    bool           `json:"is_read" gorm:"default:false"`
-	CreatedAt time.Time      `json:"CreatedAt"`
-	UpdatedAt time.Time      `json:"UpdatedAt"`
-	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+	Type        string          `json:"type" gorm:"size:10;not null;default:text"`
+	RoomID      uint            `json:"room_id" gorm:"not null;index"`
+	Room        ChatRoom        `json:"-" gorm:"foreignKey:RoomID"`
+	SenderID    uint            `json:"sender_id" gorm:"not null;index"`
+	Sender      User            `json:"sender" gorm:"foreignKey:SenderID"`
+	Content     string          `json:"content" gorm:"type:text;not null"`
+	ParentID    *uint           `json:"parent_id" gorm:"index"`
+	ReplyCount  int             `json:"reply_count" gorm:"not null;default:0"`
+	LastReplyAt *time.Time      `json:"last_reply_at"`
+	IsRead      bool            `json:"is_read" gorm:"-"`
+	SeenBy      []uint          `json:"seen_by,omitempty" gorm:"-"`
+	EditedAt    *time.Time      `json:"edited_at"`
+	Reactions   []ReactionCount `json:"reactions" gorm:"-"`
+	Attachments []Attachment    `json:"attachments" gorm:"-"`
+	IsPinned    bool            `json:"is_pinned" gorm:"-"`
+	IsStarred   bool            `json:"is_starred" gorm:"-"`
+	IsDeleted   bool            `json:"is_deleted" gorm:"-"`
+	CreatedAt   time.Time       `json:"CreatedAt"`
+	UpdatedAt   time.Time       `json:"UpdatedAt"`
+	DeletedAt   gorm.DeletedAt  `json:"-" gorm:"index"`
 }
 
-// RoomMember - explicit join table
+// AfterFind turns deleted messages, which are only loaded by unscoped
+// history queries, into tombstones without content
+func (m *Message) AfterFind(tx *gorm.DB) error {
+	if m.DeletedAt.Valid {
+		m.IsDeleted = true
+		m.Content = ""
+	}
+	return nil
+}
+
+// Roles of group members. The owner manages admins and can hand the room
+// over; admins manage members, pins and settings.
+const (
+	RoomRoleOwner  = "owner"
+	RoomRoleAdmin  = "admin"
+	RoomRoleMember = "member"
+)
+
+// RoomMember - explicit join table. LastReadMessageID is the member's read
+// cursor: every message of the room up to that ID has been read.
+// LastPostedAt is when the member last sent a message, for slow mode.
 type RoomMember struct {
-	RoomID    uint      `gorm:"primaryKey;column:room_id" json:"room_id"`
-	UserID    uint      `gorm:"primaryKey;column:user_id" json:"user_id"`
-	JoinedAt  time.Time `gorm:"autoCreateTime" json:"joined_at"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	RoomID            uint       `gorm:"primaryKey;column:room_id" json:"room_id"`
+	UserID            uint       `gorm:"primaryKey;column:user_id" json:"user_id"`
+	Role              string     `gorm:"size:10;not null;default:member" json:"role"`
+	JoinedAt          time.Time  `gorm:"autoCreateTime" json:"joined_at"`
+	LastReadMessageID uint       `gorm:"not null;default:0" json:"last_read_message_id"`
+	LastReadAt        *time.Time `json:"last_read_at"`
+	LastPostedAt      *time.Time `json:"-"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
 }
 
 func (RoomMember) TableName() string {
 	return "room_members"
 }
+
+// IsAdmin tells whether the member manages the room
+func (m *RoomMember) IsAdmin() bool {
+	return m.Role == RoomRoleOwner || m.Role == RoomRoleAdmin
+}
+
+// PreloadSender preloads the Sender of messages, including deleted accounts
+func PreloadSender(db *gorm.DB) *gorm.DB {
+	return db.Preload("Sender", func(tx *gorm.DB) *gorm.DB {
+		return tx.Unscoped()
+	})
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// FailedLogin is an audit record of a rejected password login
+type FailedLogin struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    *uint     `gorm:"index" json:"user_id"` // nil when the email matches no account
+	Email     string    `gorm:"not null;index" json:"email"`
+	IPAddress string    `gorm:"index" json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	Reason    string    `gorm:"not null" json:"reason"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
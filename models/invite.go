@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// RoomInvite is a shareable link to join a group room. MaxUses of zero means
+// unlimited; a revoked, expired or used up invite can no longer be used.
+type RoomInvite struct {
+	ID          uint             `gorm:"primarykey" json:"id"`
+	RoomID      uint             `gorm:"not null;index" json:"room_id"`
+	Code        string           `gorm:"size:32;not null;uniqueIndex" json:"code"`
+	CreatedByID uint             `gorm:"not null" json:"created_by_id"`
+	ExpiresAt   *time.Time       `json:"expires_at"`
+	MaxUses     int              `gorm:"not null;default:0" json:"max_uses"`
+	Uses        int              `gorm:"not null;default:0" json:"uses"`
+	RevokedAt   *time.Time       `json:"revoked_at"`
+	Joins       []RoomInviteJoin `gorm:"foreignKey:InviteID" json:"joins,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// Usable reports whether the invite still lets people join
+func (i *RoomInvite) Usable(now time.Time) bool {
+	if i.RevokedAt != nil {
+		return false
+	}
+	if i.ExpiresAt != nil && !now.Before(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+// RoomInviteJoin records who joined a room through which invite
+type RoomInviteJoin struct {
+	ID       uint      `gorm:"primarykey" json:"id"`
+	InviteID uint      `gorm:"not null;index" json:"invite_id"`
+	RoomID   uint      `gorm:"not null" json:"room_id"`
+	UserID   uint      `gorm:"not null" json:"user_id"`
+	User     *User     `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	JoinedAt time.Time `gorm:"autoCreateTime" json:"joined_at"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Kinds of mention: @username, @room (every member) and @here (members online)
+const (
+	MentionUser = "user"
+	MentionRoom = "room"
+	MentionHere = "here"
+)
+
+// Mention records that a message mentions a member of its room
+type Mention struct {
+	ID        uint      `gorm:"primarykey;index:idx_mentions_user_id_id,priority:2" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_mention_message_user" json:"message_id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_mention_message_user;index:idx_mentions_user_id_id,priority:1" json:"user_id"`
+	RoomID    uint      `gorm:"not null;index" json:"room_id"`
+	SenderID  uint      `gorm:"not null" json:"sender_id"`
+	Kind      string    `gorm:"size:10;not null" json:"kind"`
+	Message   *Message  `gorm:"foreignKey:MessageID" json:"message,omitempty"`
+	IsRead    bool      `gorm:"-" json:"is_read"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// MessageEdit keeps the content a message had before an edit
+type MessageEdit struct {
+	ID              uint      `gorm:"primarykey" json:"id"`
+	MessageID       uint      `gorm:"not null;index" json:"message_id"`
+	EditorID        uint      `gorm:"not null" json:"editor_id"`
+	PreviousContent string    `gorm:"type:text;not null" json:"previous_content"`
+	EditedAt        time.Time `gorm:"not null" json:"edited_at"`
+}
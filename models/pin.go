@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// PinnedMessage is a message pinned to the top of its room by a room admin
+type PinnedMessage struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	RoomID     uint      `gorm:"not null;index" json:"room_id"`
+	MessageID  uint      `gorm:"not null;uniqueIndex" json:"message_id"`
+	PinnedByID uint      `gorm:"not null" json:"pinned_by_id"`
+	Message    *Message  `gorm:"foreignKey:MessageID" json:"message,omitempty"`
+	CreatedAt  time.Time `json:"pinned_at"`
+}
+
+// StarredMessage is a message bookmarked by a user for themselves
+type StarredMessage struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_starred_user_message" json:"user_id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_starred_user_message;index" json:"message_id"`
+	RoomID    uint      `gorm:"not null" json:"room_id"`
+	Message   *Message  `gorm:"foreignKey:MessageID" json:"message,omitempty"`
+	CreatedAt time.Time `json:"starred_at"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Reaction is one user's emoji on a message
+type Reaction struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_reaction_message_user_emoji" json:"message_id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_reaction_message_user_emoji" json:"user_id"`
+	Emoji     string    `gorm:"not null;size:32;uniqueIndex:idx_reaction_message_user_emoji" json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionCount aggregates the reactions of one emoji on a message.
+// Reacted tells whether the user loading the message is among them.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
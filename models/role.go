@@ -0,0 +1,38 @@
+package models
+
+// Roles a user can have
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permissions checked by middleware.RequirePermission
+const (
+	PermUsersRead   = "users:read"
+	PermUsersManage = "users:manage" // ban, unban, force logout
+	PermRolesManage = "roles:manage"
+)
+
+// RolePermissions maps each role to the permissions it grants
+var RolePermissions = map[string][]string{
+	RoleUser:      {},
+	RoleModerator: {PermUsersRead, PermUsersManage},
+	RoleAdmin:     {PermUsersRead, PermUsersManage, PermRolesManage},
+}
+
+// IsValidRole reports whether role is a known role
+func IsValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether role grants permission
+func HasPermission(role, permission string) bool {
+	for _, p := range RolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session is a server-side login session. Access tokens carry the session ID
+// so a session can be revoked before the token expires.
+type Session struct {
+	gorm.Model
+	UserID            uint       `gorm:"not null;index" json:"user_id"`
+	User              User       `json:"-" gorm:"foreignKey:UserID"`
+	RefreshTokenHash  string     `gorm:"not null;uniqueIndex" json:"-"`
+	PreviousTokenHash string     `gorm:"index" json:"-"`
+	DeviceName        string     `json:"device_name"`
+	UserAgent         string     `json:"user_agent"`
+	IPAddress         string     `json:"ip_address"`
+	LastUsedAt        time.Time  `json:"last_used_at"`
+	ExpiresAt         time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt         *time.Time `json:"revoked_at,omitempty"`
+	Current           bool       `gorm:"-" json:"current"`
+}
+
+// IsActive reports whether the session can still be used
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
@@ -8,17 +8,43 @@ import (
 	"gorm.io/gorm"
 )
 
+// DeletedUserName replaces the name of deleted accounts wherever they still appear
+const DeletedUserName = "Deleted user"
+
 type User struct {
 	gorm.Model
-	Name       string         `gorm:"not null" json:"name"`
-	Username   string         `gorm:"not null" json:"username"`
-	Email      string         `gorm:"unique;not null" json:"email"`
-	Password   string         `gorm:"not null" json:"-"`
-	IsOnline   bool           `gorm:"default:false" json:"is_online"`
-	LastSeenAt *time.Time     `json:"last_seen_at"`
-	CreatedAt  time.Time      `json:"CreatedAt"`
-	UpdatedAt  time.Time      `json:"UpdatedAt"`
-	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
+	Name            string         `gorm:"not null" json:"name"`
+	Username        string         `gorm:"not null" json:"username"`
+	AvatarURL       string         `json:"avatar_url"`
+	Email           string         `gorm:"unique;not null" json:"email"`
+	Password        string         `gorm:"not null" json:"-"`
+	IsOnline        bool           `gorm:"default:false" json:"is_online"`
+	LastSeenAt      *time.Time     `json:"last_seen_at"`
+	EmailVerifiedAt *time.Time     `json:"email_verified_at"`
+	TOTPSecret      string         `json:"-"`
+	TOTPEnabled     bool           `gorm:"default:false" json:"mfa_enabled"`
+	TOTPLastCounter int64          `json:"-"`
+	Role            string         `gorm:"not null;default:user" json:"role"`
+	BannedAt        *time.Time     `json:"banned_at,omitempty"`
+	BanReason       string         `json:"ban_reason,omitempty"`
+	AnonymizedAt    *time.Time     `json:"-"`
+	CreatedAt       time.Time      `json:"CreatedAt"`
+	UpdatedAt       time.Time      `json:"UpdatedAt"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// AfterFind hides the profile of deleted accounts, which are only loaded
+// by unscoped queries such as the sender of an old message
+func (u *User) AfterFind(tx *gorm.DB) error {
+	if u.DeletedAt.Valid {
+		u.Name = DeletedUserName
+		u.Username = ""
+		u.Email = ""
+		u.AvatarURL = ""
+		u.IsOnline = false
+		u.LastSeenAt = nil
+	}
+	return nil
 }
 
 func (u *User) HashPassword() error {
@@ -30,6 +56,22 @@ func (u *User) HashPassword() error {
 	return nil
 }
 
+// Can reports whether the user's role grants permission
+func (u *User) Can(permission string) bool {
+	return HasPermission(u.Role, permission)
+}
+
+// IsBanned reports whether an admin banned the user
+func (u *User) IsBanned() bool {
+	return u.BannedAt != nil
+}
+
+// HasPassword reports whether the user can sign in with a password. Accounts
+// created through a social login have none until they set one.
+func (u *User) HasPassword() bool {
+	return u.Password != ""
+}
+
 func (u *User) CheckPassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 	return err == nil
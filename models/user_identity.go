@@ -0,0 +1,13 @@
+package models
+
+import "gorm.io/gorm"
+
+// UserIdentity links a user to an account at an external OIDC provider
+type UserIdentity struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index" json:"user_id"`
+	User     User   `json:"-" gorm:"foreignKey:UserID"`
+	Provider string `gorm:"not null;uniqueIndex:idx_identity_provider_subject" json:"provider"`
+	Subject  string `gorm:"not null;uniqueIndex:idx_identity_provider_subject" json:"-"`
+	Email    string `json:"email"`
+}
@@ -3,6 +3,7 @@ package routes
 import (
 	"my-ecomm/controllers"
 	"my-ecomm/middleware"
+	"my-ecomm/models"
 	"my-ecomm/services"
 
 	"github.com/gin-gonic/gin"
@@ -14,61 +15,140 @@ func SetupRoutes(router *gin.Engine) {
 	userController := controllers.NewUserController()
 	chatController := controllers.NewChatController()
 	presenceController := controllers.NewPresenceController() // NEW
+	adminController := controllers.NewAdminController()
+	apiKeyController := controllers.NewAPIKeyController()
+	attachmentController := controllers.NewAttachmentController()
+	profileController := controllers.NewProfileController()
+
+	router.GET("/.well-known/jwks.json", authController.JWKS)
 
 	v1 := router.Group("/api/v1")
 	{
 		auth := v1.Group("/auth")
 		{
 			auth.POST("/register", authController.Register)
-			auth.POST("/login", func(c *gin.Context) {
-				authController.Login(c)
-
-				// Mark user as online after login
-				if userID, exists := c.Get("userID"); exists {
-					services.GetPresenceService().UserConnected(userID.(uint))
-				}
-			})
-			auth.POST("/logout", middleware.AuthMiddleware(), func(c *gin.Context) {
+			auth.POST("/login", withPresence(authController.Login))
+			auth.GET("/oidc/:provider/start", authController.OIDCStart)
+			auth.GET("/oidc/:provider/callback", withPresence(authController.OIDCCallback))
+			auth.POST("/mfa/verify", withPresence(authController.VerifyMFA))
+			auth.POST("/mfa/setup", middleware.AuthMiddleware(), middleware.RequireSession(), authController.SetupMFA)
+			auth.POST("/mfa/enable", middleware.AuthMiddleware(), middleware.RequireSession(), authController.EnableMFA)
+			auth.POST("/mfa/disable", middleware.AuthMiddleware(), middleware.RequireSession(), authController.DisableMFA)
+			auth.POST("/refresh", authController.Refresh)
+			auth.POST("/forgot-password", authController.ForgotPassword)
+			auth.POST("/reset-password", authController.ResetPassword)
+			auth.POST("/verify-email", authController.VerifyEmail)
+			auth.POST("/verify-email/resend", middleware.AuthMiddleware(), middleware.RequireSession(), authController.ResendVerificationEmail)
+			auth.POST("/logout", middleware.AuthMiddleware(), middleware.RequireSession(), func(c *gin.Context) {
 				userID := c.GetUint("userID")
 
 				// Mark user as offline
 				services.GetPresenceService().UserDisconnected(userID)
 
-				c.JSON(200, gin.H{"message": "Logged out successfully"})
+				authController.Logout(c)
 			})
+			auth.GET("/sessions", middleware.AuthMiddleware(), middleware.RequireSession(), authController.GetSessions)
+			auth.DELETE("/sessions/:id", middleware.AuthMiddleware(), middleware.RequireSession(), authController.RevokeSession)
 		}
 
 		protected := v1.Group("")
 		protected.Use(middleware.AuthMiddleware())
 		{
 			// Product routes
-			protected.POST("/products", productController.CreateProduct)
-			protected.GET("/products", productController.GetAllProductsUser)
-			protected.GET("/products/:id", productController.GetProductById)
+			protected.POST("/products", middleware.RequireScope(models.ScopeProductsWrite), productController.CreateProduct)
+			protected.GET("/products", middleware.RequireScope(models.ScopeProductsRead), productController.GetAllProductsUser)
+			protected.GET("/products/:id", middleware.RequireScope(models.ScopeProductsRead), productController.GetProductById)
+
+			// Profile routes
+			protected.GET("/me", middleware.RequireScope(models.ScopeUsersRead), profileController.GetMe)
+			protected.PATCH("/me", middleware.RequireSession(), profileController.UpdateMe)
+			protected.POST("/me/password", middleware.RequireSession(), profileController.ChangePassword)
+			protected.DELETE("/me", middleware.RequireSession(), profileController.DeleteMe)
+			protected.GET("/me/export", middleware.RequireSession(), profileController.ExportMe)
 
 			// User routes
-			protected.GET("/users", userController.GetAllUsers)
-			protected.GET("/users/:id", userController.GetUserByID)
+			protected.GET("/users", middleware.RequireScope(models.ScopeUsersRead), middleware.RequirePermission(models.PermUsersRead), userController.GetAllUsers)
+			protected.GET("/users/:id", middleware.RequireScope(models.ScopeUsersRead), userController.GetUserByID)
 
 			// Presence routes (NEW)
-			protected.POST("/presence/heartbeat", presenceController.Heartbeat)
-			protected.POST("/presence/status", presenceController.GetOnlineStatus)
-			protected.GET("/presence/online", presenceController.GetAllOnlineUsers)
+			protected.POST("/presence/heartbeat", middleware.RequireScope(models.ScopeUsersRead), presenceController.Heartbeat)
+			protected.POST("/presence/status", middleware.RequireScope(models.ScopeUsersRead), presenceController.GetOnlineStatus)
+			protected.GET("/presence/online", middleware.RequireScope(models.ScopeUsersRead), presenceController.GetAllOnlineUsers)
 
 			// Chat room routes
-			protected.POST("/chat/rooms", chatController.CreateRoom)
-			protected.POST("/chat/direct", chatController.CreateDirectChat)
-			protected.GET("/chat/rooms", chatController.GetUserRooms)
-			protected.GET("/chat/rooms/:id", chatController.GetRoomByID)
-			protected.POST("/chat/rooms/:id/members", chatController.AddMemberToRoom)
+			protected.POST("/chat/rooms", middleware.RequireScope(models.ScopeChatWrite), chatController.CreateRoom)
+			protected.POST("/chat/direct", middleware.RequireScope(models.ScopeChatWrite), chatController.CreateDirectChat)
+			protected.GET("/chat/rooms", middleware.RequireScope(models.ScopeChatRead), chatController.GetUserRooms)
+			protected.GET("/chat/unread", middleware.RequireScope(models.ScopeChatRead), chatController.GetUnreadTotals)
+			protected.GET("/chat/rooms/:id", middleware.RequireScope(models.ScopeChatRead), chatController.GetRoomByID)
+			protected.PATCH("/chat/rooms/:id", middleware.RequireScope(models.ScopeChatWrite), chatController.UpdateRoom)
+			protected.GET("/chat/rooms/:id/members", middleware.RequireScope(models.ScopeChatRead), chatController.GetRoomMembers)
+			protected.POST("/chat/rooms/:id/members", middleware.RequireScope(models.ScopeChatWrite), chatController.AddMemberToRoom)
+			protected.DELETE("/chat/rooms/:id/members/:userId", middleware.RequireScope(models.ScopeChatWrite), chatController.RemoveMember)
+			protected.PUT("/chat/rooms/:id/members/:userId/role", middleware.RequireScope(models.ScopeChatWrite), chatController.SetMemberRole)
+			protected.POST("/chat/rooms/:id/leave", middleware.RequireScope(models.ScopeChatWrite), chatController.LeaveRoom)
+			protected.POST("/chat/rooms/:id/transfer", middleware.RequireScope(models.ScopeChatWrite), chatController.TransferOwnership)
+			protected.GET("/chat/rooms/:id/invites", middleware.RequireScope(models.ScopeChatRead), chatController.GetRoomInvites)
+			protected.POST("/chat/rooms/:id/invites", middleware.RequireScope(models.ScopeChatWrite), chatController.CreateInvite)
+			protected.GET("/chat/invites/:code", middleware.RequireScope(models.ScopeChatRead), chatController.PreviewInvite)
+			protected.POST("/chat/invites/:code/join", middleware.RequireScope(models.ScopeChatWrite), chatController.JoinWithInvite)
+			protected.DELETE("/chat/invites/:code", middleware.RequireScope(models.ScopeChatWrite), chatController.RevokeInvite)
 
 			// Message routes
-			protected.GET("/chat/rooms/:id/messages", chatController.GetRoomMessages)
-			protected.POST("/chat/rooms/:id/messages", chatController.SendMessage)
-			protected.PUT("/chat/messages/:id/read", chatController.MarkMessageAsRead)
+			protected.GET("/chat/rooms/:id/messages", middleware.RequireScope(models.ScopeChatRead), chatController.GetRoomMessages)
+			protected.POST("/chat/rooms/:id/messages", middleware.RequireScope(models.ScopeChatWrite), chatController.SendMessage)
+			protected.PUT("/chat/messages/:id", middleware.RequireScope(models.ScopeChatWrite), chatController.UpdateMessage)
+			protected.DELETE("/chat/messages/:id", middleware.RequireScope(models.ScopeChatWrite), chatController.DeleteMessage)
+			protected.GET("/chat/messages/:id/thread", middleware.RequireScope(models.ScopeChatRead), chatController.GetThread)
+			protected.GET("/chat/mentions", middleware.RequireScope(models.ScopeChatRead), chatController.GetMentions)
+			protected.GET("/chat/search", middleware.RequireScope(models.ScopeChatRead), chatController.SearchMessages)
+			protected.POST("/chat/rooms/:id/attachments", middleware.RequireScope(models.ScopeChatWrite), attachmentController.UploadAttachment)
+			protected.GET("/chat/attachments/:id", middleware.RequireScope(models.ScopeChatRead), attachmentController.DownloadAttachment)
+			protected.GET("/chat/attachments/:id/thumbnail", middleware.RequireScope(models.ScopeChatRead), attachmentController.DownloadThumbnail)
+			protected.GET("/chat/rooms/:id/pins", middleware.RequireScope(models.ScopeChatRead), chatController.GetPinnedMessages)
+			protected.POST("/chat/messages/:id/pin", middleware.RequireScope(models.ScopeChatWrite), chatController.PinMessage)
+			protected.DELETE("/chat/messages/:id/pin", middleware.RequireScope(models.ScopeChatWrite), chatController.UnpinMessage)
+			protected.GET("/chat/starred", middleware.RequireScope(models.ScopeChatRead), chatController.GetStarredMessages)
+			protected.POST("/chat/messages/:id/star", middleware.RequireScope(models.ScopeChatWrite), chatController.StarMessage)
+			protected.DELETE("/chat/messages/:id/star", middleware.RequireScope(models.ScopeChatWrite), chatController.UnstarMessage)
+			protected.POST("/chat/messages/:id/reactions", middleware.RequireScope(models.ScopeChatWrite), chatController.AddReaction)
+			protected.DELETE("/chat/messages/:id/reactions/:emoji", middleware.RequireScope(models.ScopeChatWrite), chatController.RemoveReaction)
+			protected.GET("/chat/messages/:id/edits", middleware.RequireScope(models.ScopeChatRead), chatController.GetMessageEdits)
+			protected.PUT("/chat/messages/:id/read", middleware.RequireScope(models.ScopeChatWrite), chatController.MarkMessageAsRead)
+			protected.POST("/chat/rooms/:id/read", middleware.RequireScope(models.ScopeChatWrite), chatController.MarkRoomRead)
+			protected.GET("/chat/messages/:id/seen-by", middleware.RequireScope(models.ScopeChatRead), chatController.GetMessageSeenBy)
+
+			// WebSocket ticket, redeemed by the WebSocket route below
+			protected.POST("/chat/ws-ticket", middleware.RequireScope(models.ScopeChatRead), chatController.CreateWSTicket)
+
+			// API key routes, only with a login session
+			protected.POST("/api-keys", middleware.RequireSession(), apiKeyController.CreateAPIKey)
+			protected.GET("/api-keys", middleware.RequireSession(), apiKeyController.GetAPIKeys)
+			protected.DELETE("/api-keys/:id", middleware.RequireSession(), apiKeyController.RevokeAPIKey)
+		}
+
+		// WebSocket route, authenticated with a ticket instead of a header
+		v1.GET("/chat/rooms/:id/ws", middleware.WSAuthMiddleware(), middleware.RequireScope(models.ScopeChatRead), chatController.HandleWebSocket)
+
+		admin := v1.Group("/admin")
+		admin.Use(middleware.AuthMiddleware(), middleware.RequireSession())
+		{
+			admin.GET("/users", middleware.RequirePermission(models.PermUsersManage), adminController.ListUsers)
+			admin.POST("/users/:id/ban", middleware.RequirePermission(models.PermUsersManage), adminController.BanUser)
+			admin.POST("/users/:id/unban", middleware.RequirePermission(models.PermUsersManage), adminController.UnbanUser)
+			admin.POST("/users/:id/logout", middleware.RequirePermission(models.PermUsersManage), adminController.ForceLogout)
+			admin.PUT("/users/:id/role", middleware.RequirePermission(models.PermRolesManage), adminController.ChangeRole)
+		}
+	}
+}
+
+// withPresence marks the user as online once a login handler has authenticated them
+func withPresence(login gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		login(c)
 
-			// WebSocket route
-			protected.GET("/chat/rooms/:id/ws", chatController.HandleWebSocket)
+		if userID, exists := c.Get("userID"); exists {
+			services.GetPresenceService().UserConnected(userID.(uint))
 		}
 	}
 }
@@ -0,0 +1,340 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAccountDeletionGrace = 30 * 24 * time.Hour
+	accountPurgeInterval        = time.Hour
+	exportBatchSize             = 500
+
+	// recentLoginWindow is how fresh the session of an account without a
+	// password has to be to delete it
+	recentLoginWindow = 10 * time.Minute
+)
+
+type AccountService struct {
+	sessionService    *SessionService
+	mfaService        *MFAService
+	attachmentService *AttachmentService
+}
+
+func NewAccountService() *AccountService {
+	return &AccountService{
+		sessionService:    NewSessionService(),
+		mfaService:        NewMFAService(),
+		attachmentService: NewAttachmentService(),
+	}
+}
+
+// DeleteAccount soft-deletes the user, removes their memberships and products
+// and signs them out everywhere. Groups they own are handed over to another
+// member, or deleted when nobody else is left. Personal data is anonymized by the purge job
+// once the grace period is over; until then messages show "Deleted user".
+// Accounts with a password have to confirm it. Those without one confirm
+// with a current MFA code, or without MFA, by having logged in recently.
+func (s *AccountService) DeleteAccount(userID, sessionID uint, password, code string) (time.Time, error) {
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		return time.Time{}, errors.New("user not found")
+	}
+	if err := s.confirmDeletion(&user, sessionID, password, code); err != nil {
+		return time.Time{}, err
+	}
+
+	var apiKeyIDs []uint
+	var newOwners map[uint]uint
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if newOwners, err = handOverOwnedRooms(tx, userID); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RoomMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.Product{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.APIKey{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Pluck("id", &apiKeyIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.APIKey{}).
+			Where("id IN ?", apiKeyIDs).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&user).Updates(map[string]interface{}{"is_online": false, "last_seen_at": time.Now()}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		return time.Time{}, errors.New("failed to delete account")
+	}
+
+	for roomID, ownerID := range newOwners {
+		GetHub().BroadcastEvent(roomID, map[string]interface{}{
+			"type":           "ownership_transferred",
+			"room_id":        roomID,
+			"user_id":        ownerID,
+			"previous_owner": userID,
+			"timestamp":      time.Now(),
+		})
+	}
+	GetPresenceService().UserDisconnected(userID)
+	for _, keyID := range apiKeyIDs {
+		GetHub().DisconnectAPIKey(keyID)
+	}
+	if err := s.sessionService.RevokeUserSessions(userID, 0); err != nil {
+		log.Printf("Failed to revoke sessions of deleted user %d: %v", userID, err)
+	}
+
+	return time.Now().Add(accountDeletionGrace()), nil
+}
+
+func (s *AccountService) confirmDeletion(user *models.User, sessionID uint, password, code string) error {
+	if user.HasPassword() {
+		if !user.CheckPassword(password) {
+			return errors.New("invalid password")
+		}
+		return nil
+	}
+	if user.TOTPEnabled {
+		if !s.mfaService.checkCode(user, code) {
+			return errors.New("invalid code")
+		}
+		return nil
+	}
+
+	var session models.Session
+	if err := config.DB.Where("id = ? AND user_id = ?", sessionID, user.ID).First(&session).Error; err != nil ||
+		session.CreatedAt.Before(time.Now().Add(-recentLoginWindow)) {
+		return errors.New("recent login required")
+	}
+	return nil
+}
+
+// PurgeDeletedAccounts anonymizes the accounts deleted longer than the grace
+// period ago and hard-deletes their remaining personal data. The user row is
+// kept, anonymized, so their messages still have a sender.
+func (s *AccountService) PurgeDeletedAccounts() (int, error) {
+	var userIDs []uint
+	if err := config.DB.Unscoped().Model(&models.User{}).
+		Where("deleted_at IS NOT NULL AND deleted_at < ? AND anonymized_at IS NULL", time.Now().Add(-accountDeletionGrace())).
+		Pluck("id", &userIDs).Error; err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, userID := range userIDs {
+		var attachments []models.Attachment
+		if err := config.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			attachments, err = anonymizeUser(tx, userID)
+			return err
+		}); err != nil {
+			log.Printf("Failed to purge deleted user %d: %v", userID, err)
+			continue
+		}
+		// Files go once their rows are gone, storage can't be rolled back
+		for _, attachment := range attachments {
+			s.attachmentService.deleteObjects(attachment)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartAccountPurgeJob runs PurgeDeletedAccounts now and then every hour
+func (s *AccountService) StartAccountPurgeJob() {
+	go func() {
+		ticker := time.NewTicker(accountPurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			if purged, err := s.PurgeDeletedAccounts(); err != nil {
+				log.Printf("Account purge failed: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d deleted account(s)", purged)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// anonymizeUser deletes the user's personal data and returns the attachments
+// whose stored files the caller has to delete
+func anonymizeUser(tx *gorm.DB, userID uint) ([]models.Attachment, error) {
+	for _, model := range []interface{}{
+		&models.Session{},
+		&models.ActionToken{},
+		&models.RecoveryCode{},
+		&models.UserIdentity{},
+		&models.APIKey{},
+		&models.FailedLogin{},
+		&models.Product{},
+		&models.Mention{},
+		&models.StarredMessage{},
+		&models.Reaction{},
+		&models.RoomInviteJoin{},
+	} {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(model).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	var attachments []models.Attachment
+	if err := tx.Where("uploader_id = ?", userID).Find(&attachments).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("uploader_id = ?", userID).Delete(&models.Attachment{}).Error; err != nil {
+		return nil, err
+	}
+	// Older versions of their messages; only senders edit their own
+	if err := tx.Where("editor_id = ?", userID).Delete(&models.MessageEdit{}).Error; err != nil {
+		return nil, err
+	}
+	inviteIDs := tx.Model(&models.RoomInvite{}).Select("id").Where("created_by_id = ?", userID)
+	if err := tx.Where("invite_id IN (?)", inviteIDs).Delete(&models.RoomInviteJoin{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("created_by_id = ?", userID).Delete(&models.RoomInvite{}).Error; err != nil {
+		return nil, err
+	}
+	// Pins belong to the room and stay, without who pinned them
+	if err := tx.Model(&models.PinnedMessage{}).Where("pinned_by_id = ?", userID).Update("pinned_by_id", 0).Error; err != nil {
+		return nil, err
+	}
+
+	return attachments, tx.Unscoped().Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"name":              models.DeletedUserName,
+		"username":          fmt.Sprintf("deleted_%d", userID),
+		"email":             fmt.Sprintf("deleted-%d@deleted.invalid", userID),
+		"password":          "",
+		"avatar_url":        "",
+		"email_verified_at": nil,
+		"totp_secret":       "",
+		"totp_enabled":      false,
+		"ban_reason":        "",
+		"anonymized_at":     time.Now(),
+	}).Error
+}
+
+// ExportData writes a ZIP archive of the user's profile, rooms, messages and products
+func (s *AccountService) ExportData(userID uint, w io.Writer) error {
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+
+	var rooms []models.ChatRoom
+	if err := config.DB.
+		Joins("JOIN room_members ON room_members.room_id = chat_rooms.id").
+		Where("room_members.user_id = ?", userID).
+		Find(&rooms).Error; err != nil {
+		return err
+	}
+
+	var products []models.Product
+	if err := config.DB.Where("user_id = ?", userID).Find(&products).Error; err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", user},
+		{"rooms.json", rooms},
+		{"products.json", products},
+	}
+	for _, file := range files {
+		if err := writeJSONFile(archive, file.name, file.data); err != nil {
+			return err
+		}
+	}
+	if err := writeMessages(archive, userID); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writeJSONFile(archive *zip.Writer, name string, data interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// writeMessages streams the user's messages in batches as one JSON array
+func writeMessages(archive *zip.Writer, userID uint) error {
+	f, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+
+	type exportedMessage struct {
+		ID        uint      `json:"id"`
+		RoomID    uint      `json:"room_id"`
+		Content   string    `json:"content"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	io.WriteString(f, "[")
+	first := true
+	var batch []models.Message
+	result := config.DB.
+		Where("sender_id = ?", userID).
+		FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+			for _, message := range batch {
+				if !first {
+					io.WriteString(f, ",")
+				}
+				first = false
+				data, err := json.Marshal(exportedMessage{
+					ID:        message.ID,
+					RoomID:    message.RoomID,
+					Content:   message.Content,
+					CreatedAt: message.CreatedAt,
+					UpdatedAt: message.UpdatedAt,
+				})
+				if err != nil {
+					return err
+				}
+				f.Write(data)
+			}
+			return nil
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	_, err = io.WriteString(f, "]\n")
+	return err
+}
+
+// accountDeletionGrace is read from ACCOUNT_DELETION_GRACE (e.g. "720h")
+func accountDeletionGrace() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE")); err == nil && d >= 0 {
+		return d
+	}
+	return defaultAccountDeletionGrace
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	purposePasswordReset = "password_reset"
+	purposeVerifyEmail   = "verify_email"
+	purposeMFAPending    = "mfa_pending"
+)
+
+// issueActionToken creates a random token for purpose and records its hash so
+// it can only be used once. Action tokens are opaque rather than JWTs, so they
+// can never pass for an access token with the published keys.
+func issueActionToken(userID uint, purpose string, ttl time.Duration) (string, error) {
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return "", errors.New("failed to generate token")
+	}
+
+	record := models.ActionToken{
+		TokenHash: utils.HashToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := config.DB.Create(&record).Error; err != nil {
+		return "", errors.New("failed to generate token")
+	}
+	return token, nil
+}
+
+// consumeActionToken validates a token for purpose, marks it used and returns its user ID
+func consumeActionToken(token, purpose string) (uint, error) {
+	record, err := checkActionToken(token, purpose)
+	if err != nil {
+		return 0, err
+	}
+	if err := useActionToken(record); err != nil {
+		return 0, err
+	}
+	return record.UserID, nil
+}
+
+// checkActionToken validates a token for purpose without using it up
+func checkActionToken(token, purpose string) (*models.ActionToken, error) {
+	var record models.ActionToken
+	if token == "" || config.DB.
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+			utils.HashToken(token), purpose, time.Now()).
+		First(&record).Error != nil {
+		return nil, errors.New("invalid or expired token")
+	}
+	return &record, nil
+}
+
+// useActionToken marks a checked token as used
+func useActionToken(record *models.ActionToken) error {
+	// Conditional update so the token cannot be redeemed twice
+	result := config.DB.Model(&models.ActionToken{}).
+		Where("id = ? AND used_at IS NULL", record.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return errors.New("invalid or expired token")
+	}
+	return nil
+}
+
+// claimActionTokenAttempt counts an attempt before the caller checks it, so
+// parallel requests can't get more than maxAttempts tries between them
+func claimActionTokenAttempt(record *models.ActionToken, maxAttempts int) error {
+	result := config.DB.Model(&models.ActionToken{}).
+		Where("id = ? AND used_at IS NULL AND attempts < ?", record.ID, maxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil || result.RowsAffected == 0 {
+		return errors.New("invalid or expired token")
+	}
+	return nil
+}
+
+// failActionToken burns the token once its attempts are used up
+func failActionToken(record *models.ActionToken, maxAttempts int) {
+	config.DB.Model(&models.ActionToken{}).
+		Where("id = ? AND used_at IS NULL AND attempts >= ?", record.ID, maxAttempts).
+		Update("used_at", time.Now())
+}
+
+// invalidateActionTokens marks every outstanding token of a user for purpose as used
+func invalidateActionTokens(userID uint, purpose string) {
+	config.DB.Model(&models.ActionToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", time.Now())
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"os"
+	"strings"
+	"time"
+)
+
+type AdminService struct {
+	sessionService *SessionService
+}
+
+func NewAdminService() *AdminService {
+	return &AdminService{
+		sessionService: NewSessionService(),
+	}
+}
+
+// ListUsers returns every user with their role and ban status
+func (s *AdminService) ListUsers() ([]models.User, error) {
+	var users []models.User
+	if err := config.DB.Order("id").Find(&users).Error; err != nil {
+		return nil, errors.New("failed to retrieve users")
+	}
+	return users, nil
+}
+
+// BanUser blocks a user from logging in and signs them out everywhere
+func (s *AdminService) BanUser(actorID, userID uint, reason string) (*models.User, error) {
+	actor, user, err := s.loadActorAndTarget(actorID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if actor.ID == user.ID {
+		return nil, errors.New("cannot ban yourself")
+	}
+	// Moderators can only ban regular users
+	if user.Role != models.RoleUser && actor.Role != models.RoleAdmin {
+		return nil, errors.New("insufficient permissions")
+	}
+
+	now := time.Now()
+	if err := config.DB.Model(user).Updates(map[string]interface{}{
+		"banned_at":  now,
+		"ban_reason": reason,
+	}).Error; err != nil {
+		return nil, errors.New("failed to ban user")
+	}
+
+	if err := s.signOutEverywhere(user.ID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %d banned by %d: %s", user.ID, actor.ID, reason)
+	return user, nil
+}
+
+// UnbanUser lifts a ban
+func (s *AdminService) UnbanUser(actorID, userID uint) (*models.User, error) {
+	actor, user, err := s.loadActorAndTarget(actorID, userID)
+	if err != nil {
+		return nil, err
+	}
+	// Same rule as BanUser: moderators can only unban regular users
+	if user.Role != models.RoleUser && actor.Role != models.RoleAdmin {
+		return nil, errors.New("insufficient permissions")
+	}
+
+	if err := config.DB.Model(user).Updates(map[string]interface{}{
+		"banned_at":  nil,
+		"ban_reason": "",
+	}).Error; err != nil {
+		return nil, errors.New("failed to unban user")
+	}
+
+	log.Printf("User %d unbanned by %d", user.ID, actor.ID)
+	return user, nil
+}
+
+// ChangeRole sets a user's role
+func (s *AdminService) ChangeRole(actorID, userID uint, role string) (*models.User, error) {
+	if !models.IsValidRole(role) {
+		return nil, errors.New("invalid role")
+	}
+
+	actor, user, err := s.loadActorAndTarget(actorID, userID)
+	if err != nil {
+		return nil, err
+	}
+	// Keep at least one admin around
+	if actor.ID == user.ID && role != models.RoleAdmin {
+		return nil, errors.New("cannot change your own role")
+	}
+
+	if err := config.DB.Model(user).Update("role", role).Error; err != nil {
+		return nil, errors.New("failed to change role")
+	}
+
+	log.Printf("User %d role changed to %s by %d", user.ID, role, actor.ID)
+	return user, nil
+}
+
+// ForceLogout revokes every session of a user and closes their connections
+func (s *AdminService) ForceLogout(actorID, userID uint) error {
+	actor, user, err := s.loadActorAndTarget(actorID, userID)
+	if err != nil {
+		return err
+	}
+	// Same rule as BanUser: moderators can only sign out regular users
+	if user.Role != models.RoleUser && actor.Role != models.RoleAdmin {
+		return errors.New("insufficient permissions")
+	}
+
+	if err := s.signOutEverywhere(user.ID); err != nil {
+		return err
+	}
+	log.Printf("User %d logged out everywhere by %d", user.ID, actor.ID)
+	return nil
+}
+
+// signOutEverywhere revokes the user's sessions and closes every socket,
+// including those opened with their API keys
+func (s *AdminService) signOutEverywhere(userID uint) error {
+	if err := s.sessionService.RevokeUserSessions(userID, 0); err != nil {
+		return err
+	}
+	var apiKeyIDs []uint
+	config.DB.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).Pluck("id", &apiKeyIDs)
+	for _, keyID := range apiKeyIDs {
+		GetHub().DisconnectAPIKey(keyID)
+	}
+	GetPresenceService().UserDisconnected(userID)
+	return nil
+}
+
+func (s *AdminService) loadActorAndTarget(actorID, userID uint) (*models.User, *models.User, error) {
+	var actor, user models.User
+	if err := config.DB.First(&actor, actorID).Error; err != nil {
+		return nil, nil, errors.New("user not found")
+	}
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		return nil, nil, errors.New("user not found")
+	}
+	return &actor, &user, nil
+}
+
+// PromoteBootstrapAdmins gives the admin role to the accounts listed in
+// ADMIN_EMAILS, so a fresh deployment has someone to manage it
+func PromoteBootstrapAdmins() {
+	emails := bootstrapAdminEmails()
+	if len(emails) == 0 {
+		return
+	}
+	result := config.DB.Model(&models.User{}).
+		Where("email IN ? AND role <> ?", emails, models.RoleAdmin).
+		Update("role", models.RoleAdmin)
+	if result.Error != nil {
+		log.Printf("Failed to promote bootstrap admins: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Promoted %d bootstrap admin(s)", result.RowsAffected)
+	}
+}
+
+func isBootstrapAdmin(email string) bool {
+	for _, adminEmail := range bootstrapAdminEmails() {
+		if strings.EqualFold(adminEmail, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func bootstrapAdminEmails() []string {
+	var emails []string
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, strings.ToLower(email))
+		}
+	}
+	return emails
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"strings"
+	"time"
+)
+
+const (
+	// apiKeyPrefix makes keys recognizable, e.g. by secret scanners
+	apiKeyPrefix = "mek_"
+
+	// Number of leading characters stored in clear to identify a key
+	apiKeyDisplayLength = 12
+
+	maxAPIKeysPerUser = 20
+)
+
+type APIKeyService struct{}
+
+func NewAPIKeyService() *APIKeyService {
+	return &APIKeyService{}
+}
+
+// CreateAPIKey issues a new key. The plaintext key is only returned here,
+// the database keeps its hash.
+func (s *APIKeyService) CreateAPIKey(userID uint, name string, scopes []string, expiresIn time.Duration) (*models.APIKey, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !models.IsValidScope(scope) {
+			return nil, "", errors.New("invalid scope: " + scope)
+		}
+	}
+
+	var count int64
+	config.DB.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).Count(&count)
+	if count >= maxAPIKeysPerUser {
+		return nil, "", errors.New("too many api keys")
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, "", errors.New("failed to generate api key")
+	}
+	plaintext := apiKeyPrefix + secret
+
+	key := models.APIKey{
+		UserID:  userID,
+		Name:    name,
+		Prefix:  plaintext[:apiKeyDisplayLength],
+		KeyHash: utils.HashToken(plaintext),
+		Scopes:  scopes,
+	}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		key.ExpiresAt = &expiresAt
+	}
+	if err := config.DB.Create(&key).Error; err != nil {
+		return nil, "", errors.New("failed to create api key")
+	}
+
+	return &key, plaintext, nil
+}
+
+// ListAPIKeys returns the user's keys that have not been revoked
+func (s *APIKeyService) ListAPIKeys(userID uint) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	if err := config.DB.
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Order("created_at DESC").
+		Find(&keys).Error; err != nil {
+		return nil, errors.New("failed to retrieve api keys")
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the user's keys and closes its WebSocket connections
+func (s *APIKeyService) RevokeAPIKey(userID, keyID uint) error {
+	result := config.DB.Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", keyID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return errors.New("failed to revoke api key")
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("api key not found")
+	}
+
+	GetHub().DisconnectAPIKey(keyID)
+	return nil
+}
+
+// Authenticate resolves a plaintext key to an active key of a user that isn't banned
+func (s *APIKeyService) Authenticate(plaintext string) (*models.APIKey, error) {
+	if !strings.HasPrefix(plaintext, apiKeyPrefix) {
+		return nil, errors.New("invalid api key")
+	}
+
+	var key models.APIKey
+	if err := config.DB.Preload("User").Where("key_hash = ?", utils.HashToken(plaintext)).First(&key).Error; err != nil {
+		return nil, errors.New("invalid api key")
+	}
+	if !key.IsActive() || key.User.IsBanned() {
+		return nil, errors.New("invalid api key")
+	}
+
+	// Avoid a write on every request
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > sessionTouchInterval {
+		now := time.Now()
+		config.DB.Model(&key).Update("last_used_at", now)
+		key.LastUsedAt = &now
+	}
+	return &key, nil
+}
+
+// IsKeyActive reports whether the key with the given ID can still be used
+func (s *APIKeyService) IsKeyActive(keyID uint) bool {
+	var key models.APIKey
+	if err := config.DB.Preload("User").First(&key, keyID).Error; err != nil {
+		return false
+	}
+	return key.IsActive() && !key.User.IsBanned()
+}
@@ -0,0 +1,304 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gabriel-vasile/mimetype"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAttachmentMaxSize = 10 << 20
+	thumbnailSize            = 320
+
+	// Uploads never sent with a message are removed after orphanAttachmentTTL
+	orphanAttachmentTTL      = 24 * time.Hour
+	orphanAttachmentInterval = time.Hour
+
+	maxAttachmentsPerMessage = 10
+)
+
+// thumbnailTypes are the image formats the standard library can decode
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+type AttachmentService struct {
+	storage Storage
+}
+
+func NewAttachmentService() *AttachmentService {
+	return &AttachmentService{
+		storage: GetStorage(),
+	}
+}
+
+// MaxSize is the largest accepted upload, read from ATTACHMENT_MAX_SIZE (bytes)
+func (s *AttachmentService) MaxSize() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("ATTACHMENT_MAX_SIZE"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultAttachmentMaxSize
+}
+
+// Upload stores a file for the room. The content type is sniffed from the
+// content, never taken from the client, and images get a thumbnail.
+func (s *AttachmentService) Upload(roomID, userID uint, header *multipart.FileHeader) (*models.Attachment, error) {
+	if !isRoomMember(roomID, userID) {
+		return nil, errors.New("access denied")
+	}
+	if header.Size == 0 {
+		return nil, errors.New("file is empty")
+	}
+	if header.Size > s.MaxSize() {
+		return nil, errors.New("file too large")
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, errors.New("failed to read file")
+	}
+	defer file.Close()
+
+	mime, err := mimetype.DetectReader(file)
+	if err != nil {
+		return nil, errors.New("failed to read file")
+	}
+
+	token, err := utils.RandomToken(16)
+	if err != nil {
+		return nil, errors.New("failed to store file")
+	}
+	attachment := models.Attachment{
+		RoomID:      roomID,
+		UploaderID:  userID,
+		FileName:    sanitizeFileName(header.Filename),
+		ContentType: mime.String(),
+		Size:        header.Size,
+		StorageKey:  fmt.Sprintf("attachments/%d/%s", roomID, token),
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.New("failed to read file")
+	}
+	if err := s.storage.Put(attachment.StorageKey, file, header.Size, attachment.ContentType); err != nil {
+		log.Printf("Failed to store attachment: %v", err)
+		return nil, errors.New("failed to store file")
+	}
+
+	if thumbnailTypes[mime.String()] {
+		s.storeThumbnail(&attachment, file)
+	}
+
+	if err := config.DB.Create(&attachment).Error; err != nil {
+		s.deleteObjects(attachment)
+		return nil, errors.New("failed to store file")
+	}
+
+	attachment.SetURLs()
+	return &attachment, nil
+}
+
+// storeThumbnail records the image size and stores its thumbnail. Images that
+// can't be decoded are kept as plain files.
+func (s *AttachmentService) storeThumbnail(attachment *models.Attachment, file multipart.File) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	width, height, err := utils.ImageSize(file)
+	if err != nil {
+		return
+	}
+	attachment.Width, attachment.Height = width, height
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	thumbnail, err := utils.Thumbnail(file, thumbnailSize)
+	if err != nil {
+		return
+	}
+
+	key := attachment.StorageKey + "_thumb.png"
+	if err := s.storage.Put(key, bytes.NewReader(thumbnail), int64(len(thumbnail)), "image/png"); err != nil {
+		log.Printf("Failed to store thumbnail: %v", err)
+		return
+	}
+	attachment.ThumbnailKey = key
+}
+
+// GetAttachment returns an attachment the user may download: members of the
+// room once it was sent, only the uploader before that
+func (s *AttachmentService) GetAttachment(attachmentID, userID uint) (*models.Attachment, error) {
+	var attachment models.Attachment
+	if err := config.DB.First(&attachment, attachmentID).Error; err != nil {
+		return nil, errors.New("attachment not found")
+	}
+	if attachment.MessageID == nil && attachment.UploaderID != userID {
+		return nil, errors.New("attachment not found")
+	}
+	if !isRoomMember(attachment.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
+
+	attachment.SetURLs()
+	return &attachment, nil
+}
+
+// Open streams the content of an attachment, or of its thumbnail
+func (s *AttachmentService) Open(attachment *models.Attachment, thumbnail bool) (io.ReadCloser, error) {
+	key := attachment.StorageKey
+	if thumbnail {
+		if attachment.ThumbnailKey == "" {
+			return nil, errors.New("attachment not found")
+		}
+		key = attachment.ThumbnailKey
+	}
+
+	body, err := s.storage.Get(key)
+	if err != nil {
+		log.Printf("Failed to read attachment %d: %v", attachment.ID, err)
+		return nil, errors.New("attachment not found")
+	}
+	return body, nil
+}
+
+// PurgeOrphanAttachments removes uploads that were never sent with a message
+func (s *AttachmentService) PurgeOrphanAttachments() (int, error) {
+	var attachments []models.Attachment
+	if err := config.DB.
+		Where("message_id IS NULL AND created_at <= ?", time.Now().Add(-orphanAttachmentTTL)).
+		Find(&attachments).Error; err != nil {
+		return 0, err
+	}
+
+	for _, attachment := range attachments {
+		s.deleteObjects(attachment)
+		if err := config.DB.Delete(&attachment).Error; err != nil {
+			return 0, err
+		}
+	}
+	return len(attachments), nil
+}
+
+// StartOrphanPurgeJob runs PurgeOrphanAttachments now and then every hour
+func (s *AttachmentService) StartOrphanPurgeJob() {
+	go func() {
+		ticker := time.NewTicker(orphanAttachmentInterval)
+		defer ticker.Stop()
+
+		for {
+			if purged, err := s.PurgeOrphanAttachments(); err != nil {
+				log.Printf("Attachment purge failed: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d unsent attachment(s)", purged)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// deleteMessageAttachments removes the files of a deleted message
+func (s *AttachmentService) deleteMessageAttachments(messageID uint) {
+	var attachments []models.Attachment
+	if err := config.DB.Where("message_id = ?", messageID).Find(&attachments).Error; err != nil {
+		return
+	}
+	for _, attachment := range attachments {
+		s.deleteObjects(attachment)
+	}
+	config.DB.Where("message_id = ?", messageID).Delete(&models.Attachment{})
+}
+
+func (s *AttachmentService) deleteObjects(attachment models.Attachment) {
+	for _, key := range []string{attachment.StorageKey, attachment.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		if err := s.storage.Delete(key); err != nil {
+			log.Printf("Failed to delete %s: %v", key, err)
+		}
+	}
+}
+
+// linkAttachments attaches the sender's unsent uploads of the room to a message
+func linkAttachments(tx *gorm.DB, message *models.Message, attachmentIDs []uint) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+	result := tx.Model(&models.Attachment{}).
+		Where("id IN ? AND room_id = ? AND uploader_id = ? AND message_id IS NULL", attachmentIDs, message.RoomID, message.SenderID).
+		Update("message_id", message.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != int64(len(attachmentIDs)) {
+		return errors.New("invalid attachment")
+	}
+	return nil
+}
+
+// ApplyAttachments fills the attachments of messages. Tombstones keep none.
+func (s *ChatService) ApplyAttachments(messages []models.Message) {
+	ids := make([]uint, 0, len(messages))
+	for _, message := range messages {
+		if !message.IsDeleted {
+			ids = append(ids, message.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	var attachments []models.Attachment
+	if err := config.DB.Where("message_id IN ?", ids).Order("id ASC").Find(&attachments).Error; err != nil {
+		return
+	}
+
+	byMessage := make(map[uint][]models.Attachment)
+	for _, attachment := range attachments {
+		attachment.SetURLs()
+		byMessage[*attachment.MessageID] = append(byMessage[*attachment.MessageID], attachment)
+	}
+	for i := range messages {
+		if list, ok := byMessage[messages[i].ID]; ok {
+			messages[i].Attachments = list
+		} else {
+			messages[i].Attachments = []models.Attachment{}
+		}
+	}
+}
+
+// sanitizeFileName keeps the base name of an upload without control characters
+func sanitizeFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) > 255 {
+		name = strings.ToValidUTF8(name[:255], "")
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
@@ -2,51 +2,266 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"my-ecomm/config"
 	"my-ecomm/models"
-	"my-ecomm/utils"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	verifyEmailTTL   = 24 * time.Hour
 )
 
-type AuthService struct{}
+// LoginResult is the outcome of the password step. When the user has MFA
+// enabled, Tokens is nil and MFAToken must be exchanged via MFAService.VerifyLogin.
+type LoginResult struct {
+	User     *models.User
+	Tokens   *TokenPair
+	MFAToken string
+}
+
+// ErrInvalidLogin is returned for both an unknown email and a wrong password
+// so the response doesn't reveal whether an account exists
+var ErrInvalidLogin = errors.New("invalid email or password")
+
+type AuthService struct {
+	sessionService *SessionService
+	mfaService     *MFAService
+	mailer         Mailer
+	throttle       *LoginThrottle
+}
 
 func NewAuthService() *AuthService {
-	return &AuthService{}
+	return &AuthService{
+		sessionService: NewSessionService(),
+		mfaService:     NewMFAService(),
+		mailer:         GetMailer(),
+		throttle:       GetLoginThrottle(),
+	}
 }
 
-func (s *AuthService) Register(email, password, name string) (*models.User, string, error) {
+// Register creates an account. An empty username is derived from the email.
+func (s *AuthService) Register(email, password, name, username string, device DeviceInfo) (*models.User, *TokenPair, error) {
 	var existingUser models.User
 	if err := config.GetDB().Where("email = ?", email).First(&existingUser).Error; err == nil {
-		return nil, "", errors.New("user already exists")
+		return nil, nil, errors.New("user already exists")
+	}
+	if username == "" {
+		username = GenerateUsername(email)
+	} else if !usernamePattern.MatchString(username) {
+		return nil, nil, errors.New("invalid username")
+	} else if usernameTaken(username, 0) {
+		return nil, nil, errors.New("username already taken")
 	}
 	user := &models.User{
 		Email:    email,
 		Password: password,
 		Name:     name,
+		Username: username,
+		Role:     models.RoleUser,
+	}
+	if isBootstrapAdmin(email) {
+		user.Role = models.RoleAdmin
 	}
 	if err := user.HashPassword(); err != nil {
-		return nil, "", errors.New("failed to hash password")
+		return nil, nil, errors.New("failed to hash password")
 	}
 	if err := config.GetDB().Create(&user).Error; err != nil {
-		return nil, "", errors.New("failed to create user")
+		return nil, nil, errors.New("failed to create user")
+	}
+	if err := s.SendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
 	}
-	token, err := utils.GenerateToken(user.ID, user.Email)
+	tokens, err := s.sessionService.CreateSession(user, device)
 	if err != nil {
-		return nil, "", errors.New("failed to generate token")
+		return nil, nil, err
 	}
-	return user, token, nil
+	return user, tokens, nil
 }
 
-func (s *AuthService) Login(email, password string) (*models.User, string, error) {
+func (s *AuthService) Login(email, password string, device DeviceInfo) (*LoginResult, error) {
+	if err := s.throttle.Check(email, device.IP); err != nil {
+		recordFailedLogin(nil, email, device, "locked")
+		return nil, err
+	}
+
 	var user models.User
 	if err := config.GetDB().Where("email= ?", email).First(&user).Error; err != nil {
-		return nil, "", errors.New("invalid credentials")
+		// Spend the same time as a password check so timing doesn't reveal the account
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		s.throttle.Failure(email, device.IP)
+		recordFailedLogin(nil, email, device, "unknown_email")
+		return nil, ErrInvalidLogin
 	}
 	if !user.CheckPassword(password) {
-		return nil, "", errors.New("invalid password")
+		s.throttle.Failure(email, device.IP)
+		recordFailedLogin(&user.ID, email, device, "wrong_password")
+		return nil, ErrInvalidLogin
+	}
+	// With MFA the counter is only cleared once the code is verified, so the
+	// password alone doesn't buy unlimited code guesses
+	if user.TOTPEnabled {
+		mfaToken, err := s.mfaService.IssuePendingToken(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{User: &user, MFAToken: mfaToken}, nil
+	}
+	s.throttle.Success(email)
+	tokens, err := s.sessionService.CreateSession(&user, device)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: &user, Tokens: tokens}, nil
+}
+
+// recordFailedLogin writes the audit record of a rejected login
+func recordFailedLogin(userID *uint, email string, device DeviceInfo, reason string) {
+	record := models.FailedLogin{
+		UserID:    userID,
+		Email:     email,
+		IPAddress: device.IP,
+		UserAgent: device.UserAgent,
+		Reason:    reason,
+	}
+	if err := config.GetDB().Create(&record).Error; err != nil {
+		log.Printf("Failed to record failed login for %s: %v", email, err)
+	}
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordHash is compared against when the email is unknown
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+// Refresh exchanges a refresh token for a new token pair
+func (s *AuthService) Refresh(refreshToken string) (*TokenPair, error) {
+	return s.sessionService.Refresh(refreshToken)
+}
+
+// Logout revokes the session the caller is authenticated with
+func (s *AuthService) Logout(sessionID uint) error {
+	return s.sessionService.RevokeSession(sessionID)
+}
+
+// GetSessions lists the devices the user is logged in on
+func (s *AuthService) GetSessions(userID, currentSessionID uint) ([]models.Session, error) {
+	return s.sessionService.GetUserSessions(userID, currentSessionID)
+}
+
+// RevokeSession signs out one of the user's devices
+func (s *AuthService) RevokeSession(userID, sessionID uint) error {
+	return s.sessionService.RevokeUserSession(userID, sessionID)
+}
+
+// SendVerificationEmail emails the user a link to confirm their address
+func (s *AuthService) SendVerificationEmail(user *models.User) error {
+	if user.EmailVerifiedAt != nil {
+		return errors.New("email already verified")
 	}
-	token, err := utils.GenerateToken(user.ID, user.Email)
+	token, err := issueActionToken(user.ID, purposeVerifyEmail, verifyEmailTTL)
 	if err != nil {
-		return nil, "", errors.New("failed to generate token")
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s/verify-email?token=%s\n\nThe link expires in 24 hours.",
+		user.Name, appURL(), token)
+	return s.mailer.Send(user.Email, "Verify your email address", body)
+}
+
+// ResendVerificationEmail sends a fresh verification link to a logged-in user
+func (s *AuthService) ResendVerificationEmail(userID uint) error {
+	var user models.User
+	if err := config.GetDB().First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	invalidateActionTokens(user.ID, purposeVerifyEmail)
+	return s.SendVerificationEmail(&user)
+}
+
+// VerifyEmail marks the email of the token's user as verified
+func (s *AuthService) VerifyEmail(token string) error {
+	userID, err := consumeActionToken(token, purposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	if err := config.GetDB().Model(&models.User{}).
+		Where("id = ? AND email_verified_at IS NULL", userID).
+		Update("email_verified_at", time.Now()).Error; err != nil {
+		return errors.New("failed to verify email")
+	}
+	return nil
+}
+
+// RequestPasswordReset emails a reset link. Unknown emails are ignored so
+// the response does not reveal which addresses have an account.
+func (s *AuthService) RequestPasswordReset(email string) error {
+	var user models.User
+	if err := config.GetDB().Where("email = ?", email).First(&user).Error; err != nil {
+		return nil
+	}
+
+	// Only the most recent reset link stays valid
+	invalidateActionTokens(user.ID, purposePasswordReset)
+
+	token, err := issueActionToken(user.ID, purposePasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. Open the link below to choose a new one:\n\n%s/reset-password?token=%s\n\nThe link expires in 1 hour. If you did not ask for this, you can ignore this email.",
+		user.Name, appURL(), token)
+	if err := s.mailer.Send(user.Email, "Reset your password", body); err != nil {
+		log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+		return errors.New("failed to send email")
+	}
+	return nil
+}
+
+// ResetPassword sets a new password and signs the user out everywhere
+func (s *AuthService) ResetPassword(token, newPassword string) error {
+	userID, err := consumeActionToken(token, purposePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	var user models.User
+	if err := config.GetDB().First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+
+	user.Password = newPassword
+	if err := user.HashPassword(); err != nil {
+		return errors.New("failed to hash password")
+	}
+
+	updates := map[string]interface{}{"password": user.Password}
+	// Receiving the reset email proves the user owns the address
+	if user.EmailVerifiedAt == nil {
+		updates["email_verified_at"] = time.Now()
+	}
+	if err := config.GetDB().Model(&user).Updates(updates).Error; err != nil {
+		return errors.New("failed to update password")
+	}
+
+	return s.sessionService.RevokeUserSessions(user.ID, 0)
+}
+
+func appURL() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return url
 	}
-	return &user, token, nil
+	return "http://localhost:3000"
 }
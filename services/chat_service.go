@@ -5,6 +5,10 @@ import (
 	"errors"
 	"my-ecomm/config"
 	"my-ecomm/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
 )
 
 type ChatService struct{}
@@ -48,6 +52,15 @@ func (s *ChatService) CreateRoom(name, description string, createdBy uint, membe
 		}
 	}
 
+	if isGroup {
+		if err := tx.Model(&models.RoomMember{}).
+			Where("room_id = ? AND user_id = ?", room.ID, createdBy).
+			Update("role", models.RoomRoleOwner).Error; err != nil {
+			tx.Rollback()
+			return nil, errors.New("failed to add members to room")
+		}
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		return nil, errors.New("failed to commit transaction")
 	}
@@ -57,8 +70,23 @@ func (s *ChatService) CreateRoom(name, description string, createdBy uint, membe
 	return &room, nil
 }
 
-// UpdateRoom updates a chat room's details
-func (s *ChatService) UpdateRoom(roomID, userID uint, name, description *string) (*models.ChatRoom, error) {
+// maxSlowModeSeconds caps the slow mode interval at six hours
+const maxSlowModeSeconds = 6 * 60 * 60
+
+// RoomUpdate holds the fields of a PATCH /chat/rooms/:id, nil fields are left unchanged
+type RoomUpdate struct {
+	Name            *string
+	Description     *string
+	Topic           *string
+	AvatarURL       *string
+	PostPolicy      *string
+	AddMemberPolicy *string
+	SlowModeSeconds *int
+}
+
+// UpdateRoom changes a group room's details and settings. Only room admins
+// may update the room; the new version is pushed to the room.
+func (s *ChatService) UpdateRoom(roomID, userID uint, update RoomUpdate) (*models.ChatRoom, error) {
 	var room models.ChatRoom
 
 	// First check if room exists
@@ -71,26 +99,52 @@ func (s *ChatService) UpdateRoom(roomID, userID uint, name, description *string)
 		return nil, errors.New("cannot update direct chat")
 	}
 
-	// Verify user is a member of the room
-	var count int64
-	config.DB.
-		Table("room_members").
-		Where("room_id = ? AND user_id = ?", roomID, userID).
-		Count(&count)
-
-	if count == 0 {
+	if !isRoomAdmin(roomID, userID) {
 		return nil, errors.New("access denied")
 	}
 
 	// Update fields if provided
 	updates := make(map[string]interface{})
 
-	if name != nil && *name != "" {
-		updates["name"] = *name
+	if update.Name != nil && strings.TrimSpace(*update.Name) != "" {
+		updates["name"] = strings.TrimSpace(*update.Name)
+	}
+
+	if update.Description != nil {
+		updates["description"] = *update.Description
+	}
+
+	if update.Topic != nil {
+		updates["topic"] = strings.TrimSpace(*update.Topic)
+	}
+
+	if update.AvatarURL != nil {
+		avatarURL := strings.TrimSpace(*update.AvatarURL)
+		if avatarURL != "" && !isHTTPURL(avatarURL) {
+			return nil, errors.New("invalid avatar url")
+		}
+		updates["avatar_url"] = avatarURL
+	}
+
+	if update.PostPolicy != nil {
+		if !validRoomPolicy(*update.PostPolicy) {
+			return nil, errors.New("invalid policy")
+		}
+		updates["setting_post_policy"] = *update.PostPolicy
+	}
+
+	if update.AddMemberPolicy != nil {
+		if !validRoomPolicy(*update.AddMemberPolicy) {
+			return nil, errors.New("invalid policy")
+		}
+		updates["setting_add_member_policy"] = *update.AddMemberPolicy
 	}
 
-	if description != nil {
-		updates["description"] = *description
+	if update.SlowModeSeconds != nil {
+		if *update.SlowModeSeconds < 0 || *update.SlowModeSeconds > maxSlowModeSeconds {
+			return nil, errors.New("invalid slow mode interval")
+		}
+		updates["setting_slow_mode_seconds"] = *update.SlowModeSeconds
 	}
 
 	if len(updates) == 0 {
@@ -104,11 +158,64 @@ func (s *ChatService) UpdateRoom(roomID, userID uint, name, description *string)
 	// Reload room with relationships
 	config.DB.Preload("Members").Preload("Creator").First(&room, room.ID)
 
+	GetHub().BroadcastEvent(room.ID, map[string]interface{}{
+		"type":       "room_updated",
+		"room":       room,
+		"updated_by": userID,
+	})
+
 	return &room, nil
 }
 
-// UpdateMessage updates a message content
+func validRoomPolicy(policy string) bool {
+	return policy == models.RoomPolicyMembers || policy == models.RoomPolicyAdmins
+}
+
+// checkCanPost applies the room's post policy to a new message and returns
+// the slow mode wait the sender is held to, zero when there is none
+func checkCanPost(roomID, userID uint) (time.Duration, error) {
+	var room models.ChatRoom
+	if err := config.DB.First(&room, roomID).Error; err != nil {
+		return 0, errors.New("room not found")
+	}
+	member, err := roomMember(roomID, userID)
+	if err != nil {
+		return 0, errors.New("user is not a member of this room")
+	}
+	if !room.IsGroup || member.IsAdmin() {
+		return 0, nil
+	}
+
+	if room.Settings.PostPolicy == models.RoomPolicyAdmins {
+		return 0, errors.New("only admins can post in this room")
+	}
+	return time.Duration(room.Settings.SlowModeSeconds) * time.Second, nil
+}
+
+// claimPostSlot records that the member posts now, unless they already did
+// within the slow mode wait. The conditional update keeps concurrent sends
+// from all getting through.
+func claimPostSlot(tx *gorm.DB, roomID, userID uint, wait time.Duration) error {
+	now := time.Now()
+	result := tx.Model(&models.RoomMember{}).
+		Where("room_id = ? AND user_id = ? AND (last_posted_at IS NULL OR last_posted_at <= ?)", roomID, userID, now.Add(-wait)).
+		Update("last_posted_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("slow mode is on, wait before sending")
+	}
+	return nil
+}
+
+// UpdateMessage updates a message content, keeping the previous content in
+// the edit history, and pushes the new version to the room
 func (s *ChatService) UpdateMessage(messageID, userID uint, newContent string) (*models.Message, error) {
+	if strings.TrimSpace(newContent) == "" {
+		return nil, errors.New("message content is required")
+	}
+
 	var message models.Message
 
 	// Find message and verify sender
@@ -116,23 +223,60 @@ func (s *ChatService) UpdateMessage(messageID, userID uint, newContent string) (
 		return nil, errors.New("message not found")
 	}
 
-	// Only the sender can update their message
-	if message.SenderID != userID {
+	// Only the sender can update their message, while still in the room.
+	// System messages are never edited.
+	if message.SenderID != userID || message.Type == models.MessageTypeSystem {
 		return nil, errors.New("only sender can update the message")
 	}
+	if !isRoomMember(message.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
 
-	// Update message content
-	if err := config.DB.Model(&message).Update("content", newContent).Error; err != nil {
-		return nil, errors.New("failed to update message")
+	var mentioned []models.Mention
+	if message.Content != newContent {
+		now := time.Now()
+		err := config.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&models.MessageEdit{
+				MessageID:       message.ID,
+				EditorID:        userID,
+				PreviousContent: message.Content,
+				EditedAt:        now,
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&message).Updates(map[string]interface{}{
+				"content":   newContent,
+				"edited_at": now,
+			}).Error; err != nil {
+				return err
+			}
+			// Only members newly mentioned by the edit are notified
+			message.Content = newContent
+			var err error
+			mentioned, err = syncMentions(tx, &message)
+			return err
+		})
+		if err != nil {
+			return nil, errors.New("failed to update message")
+		}
 	}
 
 	// Reload message with sender info
-	config.DB.Preload("Sender").First(&message, message.ID)
+	config.DB.Scopes(models.PreloadSender).First(&message, message.ID)
+	updated := []models.Message{message}
+	s.ApplyAttachments(updated)
+	message = updated[0]
+
+	GetHub().BroadcastEvent(message.RoomID, map[string]interface{}{
+		"type":    "message_updated",
+		"message": message,
+	})
+	notifyMentions(mentioned, &message)
 
 	return &message, nil
 }
 
-// DeleteMessage soft deletes a message
+// DeleteMessage soft deletes a message. History keeps a tombstone in its place.
 func (s *ChatService) DeleteMessage(messageID, userID uint) error {
 	var message models.Message
 
@@ -141,19 +285,79 @@ func (s *ChatService) DeleteMessage(messageID, userID uint) error {
 		return errors.New("message not found")
 	}
 
-	// Only the sender can delete their message
-	if message.SenderID != userID {
+	// Only the sender can delete their message, while still in the room.
+	// System messages are never deleted.
+	if message.SenderID != userID || message.Type == models.MessageTypeSystem {
 		return errors.New("only sender can delete the message")
 	}
+	if !isRoomMember(message.RoomID, userID) {
+		return errors.New("access denied")
+	}
 
-	// Soft delete the message
-	if err := config.DB.Delete(&message).Error; err != nil {
+	// Soft delete the message, a reply no longer counts in its thread
+	var wasPinned bool
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&message).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", message.ID).Delete(&models.Mention{}).Error; err != nil {
+			return err
+		}
+		var err error
+		if wasPinned, err = removePinsAndStars(tx, message.ID); err != nil {
+			return err
+		}
+		if message.ParentID != nil {
+			// The thread's last reply may be the one just deleted
+			return tx.Model(&models.Message{}).
+				Where("id = ? AND reply_count > 0", *message.ParentID).
+				Updates(map[string]interface{}{
+					"reply_count": gorm.Expr("reply_count - 1"),
+					"last_reply_at": tx.Model(&models.Message{}).
+						Select("MAX(created_at)").
+						Where("parent_id = ?", *message.ParentID),
+				}).Error
+		}
+		return nil
+	})
+	if err != nil {
 		return errors.New("failed to delete message")
 	}
+	NewAttachmentService().deleteMessageAttachments(message.ID)
+
+	GetHub().BroadcastEvent(message.RoomID, map[string]interface{}{
+		"type":       "message_deleted",
+		"message_id": message.ID,
+		"room_id":    message.RoomID,
+		"deleted_at": time.Now(),
+	})
+	if message.ParentID != nil {
+		broadcastThreadUpdated(*message.ParentID)
+	}
+	if wasPinned {
+		broadcastUnpinned(message.RoomID, message.ID)
+	}
 
 	return nil
 }
 
+// GetMessageEdits returns the previous versions of a message, oldest first
+func (s *ChatService) GetMessageEdits(messageID, userID uint) ([]models.MessageEdit, error) {
+	var message models.Message
+	if err := config.DB.First(&message, messageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+	if !isRoomMember(message.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
+
+	var edits []models.MessageEdit
+	if err := config.DB.Where("message_id = ?", messageID).Order("edited_at ASC").Find(&edits).Error; err != nil {
+		return nil, errors.New("failed to retrieve edits")
+	}
+	return edits, nil
+}
+
 // GetRoomByID gets a room by ID
 func (s *ChatService) GetRoomByID(roomID uint, userID uint) (*models.ChatRoom, error) {
 	var room models.ChatRoom
@@ -208,135 +412,386 @@ func (s *ChatService) GetUserRooms(userID uint) ([]models.ChatRoom, error) {
 	return rooms, nil
 }
 
-// SendMessage creates a new message
-func (s *ChatService) SendMessage(content string, roomID, senderID uint) (*models.Message, error) {
-	// Verify user is member of room
-	var count int64
-	config.DB.
-		Table("room_members").
-		Where("room_id = ? AND user_id = ?", roomID, senderID).
-		Count(&count)
+// SendMessageParams describes a message to post. ParentID makes it a reply
+// in the thread of that message; AttachmentIDs are uploads of the sender
+// in the room, sent along with the message.
+type SendMessageParams struct {
+	RoomID        uint
+	SenderID      uint
+	Content       string
+	ParentID      *uint
+	AttachmentIDs []uint
+}
 
-	if count == 0 {
-		return nil, errors.New("user is not a member of this room")
+// SendMessage creates a new message and broadcasts it to the room. It is the
+// single send path for REST and WebSocket clients.
+func (s *ChatService) SendMessage(params SendMessageParams) (*models.Message, error) {
+	if strings.TrimSpace(params.Content) == "" && len(params.AttachmentIDs) == 0 {
+		return nil, errors.New("message content is required")
+	}
+	if len(params.AttachmentIDs) > maxAttachmentsPerMessage {
+		return nil, errors.New("too many attachments")
+	}
+
+	// Verify user is member of room and allowed to post
+	slowMode, err := checkCanPost(params.RoomID, params.SenderID)
+	if err != nil {
+		return nil, err
 	}
 
 	message := models.Message{
-		Content:  content,
-		RoomID:   roomID,
-		SenderID: senderID,
-		IsRead:   false,
+		Type:     models.MessageTypeText,
+		Content:  params.Content,
+		RoomID:   params.RoomID,
+		SenderID: params.SenderID,
 	}
 
-	if err := config.DB.Create(&message).Error; err != nil {
+	var parent *models.Message
+	var mentioned []models.Mention
+	if params.ParentID != nil {
+		if parent, err = threadRoot(*params.ParentID, params.RoomID); err != nil {
+			return nil, err
+		}
+		message.ParentID = &parent.ID
+	}
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if slowMode > 0 {
+			if err := claimPostSlot(tx, params.RoomID, params.SenderID, slowMode); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		if err := linkAttachments(tx, &message, params.AttachmentIDs); err != nil {
+			return err
+		}
+		var err error
+		if mentioned, err = syncMentions(tx, &message); err != nil {
+			return err
+		}
+		if parent != nil {
+			return tx.Model(&models.Message{}).Where("id = ?", parent.ID).Updates(map[string]interface{}{
+				"reply_count":   gorm.Expr("reply_count + 1"),
+				"last_reply_at": message.CreatedAt,
+			}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		switch err.Error() {
+		case "invalid attachment", "slow mode is on, wait before sending":
+			return nil, err
+		}
 		return nil, errors.New("failed to send message")
 	}
+	s.AdvanceReadCursor(params.RoomID, params.SenderID, message.ID)
+
+	// Update room's updated_at
+	config.DB.Model(&models.ChatRoom{}).Where("id = ?", params.RoomID).Update("updated_at", message.CreatedAt)
 
 	// Preload sender info
-	config.DB.Preload("Sender").First(&message, message.ID)
+	config.DB.Scopes(models.PreloadSender).First(&message, message.ID)
+	if len(params.AttachmentIDs) > 0 {
+		sent := []models.Message{message}
+		s.ApplyAttachments(sent)
+		message = sent[0]
+	}
+
+	hub := GetHub()
+	hub.BroadcastEvent(params.RoomID, map[string]interface{}{
+		"type":    "message",
+		"message": message,
+	})
+	if parent != nil {
+		broadcastThreadUpdated(parent.ID)
+	}
+	notifyMentions(mentioned, &message)
 
 	return &message, nil
 }
 
-// GetRoomMessages gets all messages for a room
-func (s *ChatService) GetRoomMessages(roomID, userID uint, limit, offset int) ([]models.Message, error) {
-	// Verify user is member of room
-	var count int64
-	config.DB.
-		Table("room_members").
-		Where("room_id = ? AND user_id = ?", roomID, userID).
-		Count(&count)
+// Page sizes of GetRoomMessages
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
 
-	if count == 0 {
+// MessageQuery selects a page of a room's history. At most one of Before,
+// After and Around is set; with none the latest messages are returned.
+// Offset is only honoured without a cursor, for older clients.
+type MessageQuery struct {
+	Before uint
+	After  uint
+	Around uint
+	Limit  int
+	Offset int
+}
+
+// MessagePage is a page of history, newest message first. NextCursor is
+// passed as ?before= to load older messages and PrevCursor as ?after= to load
+// newer ones; each is nil when there is nothing more in that direction.
+type MessagePage struct {
+	Messages   []models.Message `json:"messages"`
+	NextCursor *uint            `json:"next_cursor"`
+	PrevCursor *uint            `json:"prev_cursor"`
+	HasOlder   bool             `json:"has_older"`
+	HasNewer   bool             `json:"has_newer"`
+}
+
+// GetRoomMessages gets a page of the room's messages, keyed by message ID so
+// that messages arriving while paging don't shift the pages
+func (s *ChatService) GetRoomMessages(roomID, userID uint, q MessageQuery) (*MessagePage, error) {
+	var room models.ChatRoom
+	if err := config.DB.First(&room, roomID).Error; err != nil {
+		return nil, errors.New("room not found")
+	}
+	if !isRoomMember(roomID, userID) {
 		return nil, errors.New("access denied")
 	}
 
-	var messages []models.Message
-	query := config.DB.
-		Preload("Sender").
-		Where("room_id = ?", roomID).
-		Order("created_at DESC")
-
-	if limit > 0 {
-		query = query.Limit(limit)
+	if q.Limit <= 0 {
+		q.Limit = defaultMessagePageSize
 	}
-	if offset > 0 {
-		query = query.Offset(offset)
+	if q.Limit > maxMessagePageSize {
+		q.Limit = maxMessagePageSize
 	}
 
-	if err := query.Find(&messages).Error; err != nil {
+	// Unscoped: deleted messages stay in the history as tombstones.
+	// Thread replies are loaded with GetThread.
+	roomMessages := func() *gorm.DB {
+		return config.DB.Unscoped().Scopes(models.PreloadSender).Where("room_id = ? AND parent_id IS NULL", roomID)
+	}
+
+	page := &MessagePage{}
+	var err error
+	switch {
+	case q.Around != 0:
+		// Up to half the page after the anchor, the rest up to and including it
+		newerLimit := q.Limit / 2
+		var older, newer []models.Message
+		if err = roomMessages().Where("id <= ?", q.Around).Order("id DESC").Limit(q.Limit - newerLimit + 1).Find(&older).Error; err != nil {
+			break
+		}
+		if err = roomMessages().Where("id > ?", q.Around).Order("id ASC").Limit(newerLimit + 1).Find(&newer).Error; err != nil {
+			break
+		}
+		older, page.HasOlder = trimPage(older, q.Limit-newerLimit)
+		newer, page.HasNewer = trimPage(newer, newerLimit)
+		page.Messages = append(reverseMessages(newer), older...)
+
+	case q.After != 0:
+		var newer []models.Message
+		if err = roomMessages().Where("id > ?", q.After).Order("id ASC").Limit(q.Limit + 1).Find(&newer).Error; err != nil {
+			break
+		}
+		newer, page.HasNewer = trimPage(newer, q.Limit)
+		page.Messages = reverseMessages(newer)
+		page.HasOlder = hasMessage(roomID, "id <= ?", q.After)
+
+	case q.Before != 0:
+		if err = roomMessages().Where("id < ?", q.Before).Order("id DESC").Limit(q.Limit + 1).Find(&page.Messages).Error; err != nil {
+			break
+		}
+		page.Messages, page.HasOlder = trimPage(page.Messages, q.Limit)
+		page.HasNewer = hasMessage(roomID, "id >= ?", q.Before)
+
+	default:
+		err = roomMessages().Order("id DESC").Limit(q.Limit + 1).Offset(q.Offset).Find(&page.Messages).Error
+		page.Messages, page.HasOlder = trimPage(page.Messages, q.Limit)
+		page.HasNewer = q.Offset > 0
+	}
+	if err != nil {
 		return nil, errors.New("failed to retrieve messages")
 	}
 
-	return messages, nil
+	if n := len(page.Messages); n > 0 {
+		if page.HasOlder {
+			page.NextCursor = &page.Messages[n-1].ID
+		}
+		if page.HasNewer {
+			page.PrevCursor = &page.Messages[0].ID
+		}
+	} else {
+		page.Messages = []models.Message{}
+	}
+
+	s.ApplyReadState(&room, page.Messages)
+	s.applyMessageDetails(page.Messages, userID)
+	return page, nil
 }
 
-// MarkMessageAsRead marks a message as read
-func (s *ChatService) MarkMessageAsRead(messageID, userID uint) error {
-	var message models.Message
+// trimPage cuts the extra row fetched to know whether there is more
+func trimPage(messages []models.Message, limit int) ([]models.Message, bool) {
+	if len(messages) > limit {
+		return messages[:limit], true
+	}
+	return messages, false
+}
 
-	// First get the message
-	if err := config.DB.First(&message, messageID).Error; err != nil {
-		return errors.New("message not found")
+func reverseMessages(messages []models.Message) []models.Message {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
 	}
+	return messages
+}
 
-	// Verify user is member of the room
-	var count int64
-	config.DB.
-		Table("room_members").
-		Where("room_id = ? AND user_id = ?", message.RoomID, userID).
-		Count(&count)
+// hasMessage reports whether the room has a message matching the condition on its ID
+func hasMessage(roomID uint, condition string, messageID uint) bool {
+	var message models.Message
+	err := config.DB.Unscoped().Select("id").Where("room_id = ? AND parent_id IS NULL", roomID).Where(condition, messageID).Take(&message).Error
+	return err == nil
+}
 
-	if count == 0 {
-		return errors.New("access denied")
-	}
+// ReadReceipt is broadcast to the room when a member's read cursor moves
+type ReadReceipt struct {
+	RoomID            uint      `json:"room_id"`
+	UserID            uint      `json:"user_id"`
+	LastReadMessageID uint      `json:"last_read_message_id"`
+	ReadAt            time.Time `json:"read_at"`
+}
 
-	return config.DB.Model(&message).Update("is_read", true).Error
+// MarkMessageAsRead marks the message, and every earlier message of its room, as read
+func (s *ChatService) MarkMessageAsRead(messageID, userID uint) (*ReadReceipt, error) {
+	var message models.Message
+	if err := config.DB.First(&message, messageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+	return s.MarkRoomRead(message.RoomID, userID, message.ID)
 }
 
-// AddMemberToRoom adds a new member to a room
-func (s *ChatService) AddMemberToRoom(roomID, userID, newMemberID uint) error {
-	var room models.ChatRoom
+// MarkRoomRead moves the user's read cursor up to messageID, or to the latest
+// message when messageID is 0. The cursor never moves backwards; a receipt is
+// broadcast to the room only when it moved.
+func (s *ChatService) MarkRoomRead(roomID, userID, messageID uint) (*ReadReceipt, error) {
+	var member models.RoomMember
+	if err := config.DB.Where("room_id = ? AND user_id = ?", roomID, userID).First(&member).Error; err != nil {
+		return nil, errors.New("access denied")
+	}
 
-	// Get room and verify it exists
-	if err := config.DB.First(&room, roomID).Error; err != nil {
-		return errors.New("room not found")
+	var message models.Message
+	query := config.DB.Select("id").Where("room_id = ?", roomID)
+	if messageID != 0 {
+		query = query.Where("id = ?", messageID)
+	}
+	if err := query.Order("id DESC").First(&message).Error; err != nil {
+		if messageID == 0 {
+			// Empty room, nothing to read
+			return &ReadReceipt{RoomID: roomID, UserID: userID, LastReadMessageID: member.LastReadMessageID}, nil
+		}
+		return nil, errors.New("message not found")
 	}
 
-	// Verify user is member or creator of room
-	var count int64
-	config.DB.
-		Table("room_members").
-		Where("room_id = ? AND user_id = ?", roomID, userID).
-		Count(&count)
+	receipt := &ReadReceipt{
+		RoomID:            roomID,
+		UserID:            userID,
+		LastReadMessageID: message.ID,
+		ReadAt:            time.Now(),
+	}
+	result := config.DB.Model(&models.RoomMember{}).
+		Where("room_id = ? AND user_id = ? AND last_read_message_id < ?", roomID, userID, message.ID).
+		Updates(map[string]interface{}{
+			"last_read_message_id": message.ID,
+			"last_read_at":         receipt.ReadAt,
+		})
+	if result.Error != nil {
+		return nil, errors.New("failed to mark as read")
+	}
+	if result.RowsAffected == 0 {
+		// Already read further
+		receipt.LastReadMessageID = member.LastReadMessageID
+		if member.LastReadAt != nil {
+			receipt.ReadAt = *member.LastReadAt
+		}
+		return receipt, nil
+	}
 
-	isCreator := room.CreatorID == userID
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":    "read_receipt",
+		"receipt": receipt,
+	})
+	return receipt, nil
+}
 
-	if count == 0 && !isCreator {
-		return errors.New("access denied")
+// GetSeenBy lists the members other than the sender who have read the message
+func (s *ChatService) GetSeenBy(messageID, userID uint) ([]models.User, error) {
+	var message models.Message
+	if err := config.DB.First(&message, messageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+	if !isRoomMember(message.RoomID, userID) {
+		return nil, errors.New("access denied")
 	}
 
-	// Find the new member
-	var newMember models.User
-	if err := config.DB.First(&newMember, newMemberID).Error; err != nil {
-		return errors.New("user not found")
+	var users []models.User
+	if err := config.DB.
+		Select("users.id, users.name, users.username, users.avatar_url").
+		Joins("JOIN room_members ON room_members.user_id = users.id").
+		Where("room_members.room_id = ? AND room_members.last_read_message_id >= ? AND users.id <> ?", message.RoomID, message.ID, message.SenderID).
+		Find(&users).Error; err != nil {
+		return nil, errors.New("failed to retrieve readers")
 	}
+	return users, nil
+}
 
-	// Check if already a member
-	var existingCount int64
-	config.DB.
-		Table("room_members").
-		Where("room_id = ? AND user_id = ?", roomID, newMemberID).
-		Count(&existingCount)
+// applyMessageDetails fills what messages show besides their content:
+// reactions, attachments, pin and star
+func (s *ChatService) applyMessageDetails(messages []models.Message, viewerID uint) {
+	s.ApplyReactions(messages, viewerID)
+	s.ApplyAttachments(messages)
+	s.ApplyPinsAndStars(messages, viewerID)
+}
 
-	if existingCount > 0 {
-		return errors.New("user is already a member")
+// ApplyReadState fills IsRead and, for group rooms, SeenBy on messages of the room
+func (s *ChatService) ApplyReadState(room *models.ChatRoom, messages []models.Message) {
+	if len(messages) == 0 {
+		return
 	}
 
-	// Add the member
-	if err := config.DB.Model(&room).Association("Members").Append(&newMember); err != nil {
-		return errors.New("failed to add member")
+	var members []models.RoomMember
+	if err := config.DB.
+		Select("user_id, last_read_message_id").
+		Where("room_id = ? AND last_read_message_id > 0", room.ID).
+		Find(&members).Error; err != nil {
+		return
+	}
+
+	for i := range messages {
+		for _, member := range members {
+			if member.UserID == messages[i].SenderID || member.LastReadMessageID < messages[i].ID {
+				continue
+			}
+			messages[i].IsRead = true
+			if room.IsGroup {
+				messages[i].SeenBy = append(messages[i].SeenBy, member.UserID)
+			}
+		}
 	}
+}
 
-	return nil
+// AdvanceReadCursor marks a message as read by its sender without
+// broadcasting a receipt, nobody needs to know the sender read their own message
+func (s *ChatService) AdvanceReadCursor(roomID, userID, messageID uint) {
+	config.DB.Model(&models.RoomMember{}).
+		Where("room_id = ? AND user_id = ? AND last_read_message_id < ?", roomID, userID, messageID).
+		Updates(map[string]interface{}{
+			"last_read_message_id": messageID,
+			"last_read_at":         time.Now(),
+		})
+}
+
+// IsRoomMember reports whether the user belongs to the room
+func (s *ChatService) IsRoomMember(roomID, userID uint) bool {
+	return isRoomMember(roomID, userID)
+}
+
+// isRoomMember reports whether the user belongs to the room
+func isRoomMember(roomID, userID uint) bool {
+	var count int64
+	config.DB.
+		Table("room_members").
+		Where("room_id = ? AND user_id = ?", roomID, userID).
+		Count(&count)
+	return count > 0
 }
@@ -3,8 +3,6 @@ package services
 import (
 	"encoding/json"
 	"log"
-	"my-ecomm/config"
-	"my-ecomm/models"
 	"sync"
 	"time"
 
@@ -27,22 +25,28 @@ const (
 
 // Message represents a websocket message structure
 type Message struct {
-	Type      string      `json:"type"`
-	Content   interface{} `json:"content"`
-	Timestamp time.Time   `json:"timestamp,omitempty"`
-	UserID    uint        `json:"userId,omitempty"`
-	Username  string      `json:"username,omitempty"`
-	Typing    interface{} `json:"typing,omitempty"` // NEW: for typing indicator
+	Type          string      `json:"type"`
+	Content       interface{} `json:"content"`
+	Timestamp     time.Time   `json:"timestamp,omitempty"`
+	UserID        uint        `json:"userId,omitempty"`
+	Username      string      `json:"username,omitempty"`
+	Typing        interface{} `json:"typing,omitempty"` // NEW: for typing indicator
+	MessageID     uint        `json:"message_id,omitempty"`
+	ParentID      *uint       `json:"parent_id,omitempty"`
+	AttachmentIDs []uint      `json:"attachment_ids,omitempty"`
 }
 
 // Client represents a websocket client
 type Client struct {
-	ID       uint
-	Username string
-	RoomID   uint
-	Conn     *websocket.Conn
-	Send     chan []byte
-	Hub      *Hub
+	ID        uint
+	Username  string
+	RoomID    uint
+	SessionID uint
+	APIKeyID  uint
+	ReadOnly  bool // chat messages from the client are ignored
+	Conn      *websocket.Conn
+	Send      chan []byte
+	Hub       *Hub
 }
 
 // Hub maintains the set of active clients and broadcasts messages
@@ -62,9 +66,16 @@ type Hub struct {
 	mu sync.RWMutex
 }
 
+// BroadcastMessage goes to every client of RoomID or, when UserID is set, to
+// every connection of that user whatever its room. With Close set, it goes to
+// the user's connections to RoomID only, which are then evicted from the room.
+// With Client set, it goes to that connection only, if still registered.
 type BroadcastMessage struct {
 	RoomID  uint
+	UserID  uint
+	Client  *Client
 	Message []byte
+	Close   bool
 }
 
 var hubInstance *Hub
@@ -122,18 +133,30 @@ func (h *Hub) Run() {
 
 		case broadcast := <-h.Broadcast:
 			h.mu.Lock()
-			if clients, ok := h.Rooms[broadcast.RoomID]; ok {
+			if broadcast.Client != nil {
+				client := broadcast.Client
+				if clients, ok := h.Rooms[client.RoomID]; ok && clients[client] {
+					h.deliver(client.RoomID, clients, client, broadcast.Message)
+				}
+			} else if broadcast.Close {
+				for client := range h.Rooms[broadcast.RoomID] {
+					if client.ID == broadcast.UserID {
+						h.deliver(broadcast.RoomID, h.Rooms[broadcast.RoomID], client, broadcast.Message)
+						h.evict(broadcast.RoomID, client)
+					}
+				}
+			} else if broadcast.UserID != 0 {
+				for roomID, clients := range h.Rooms {
+					for client := range clients {
+						if client.ID == broadcast.UserID {
+							h.deliver(roomID, clients, client, broadcast.Message)
+						}
+					}
+				}
+			} else if clients, ok := h.Rooms[broadcast.RoomID]; ok {
 				log.Printf("[HUB-BROADCAST] Sending message to room %d with %d clients\n", broadcast.RoomID, len(clients))
 				for client := range clients {
-					select {
-					case client.Send <- broadcast.Message:
-						log.Printf("  ✓ Sent to client %d in room %d\n", client.ID, broadcast.RoomID)
-					default:
-						// Client's send channel is full, close and remove
-						log.Printf("  ✗ Client %d send channel FULL - removing from room %d\n", client.ID, broadcast.RoomID)
-						close(client.Send)
-						delete(clients, client)
-					}
+					h.deliver(broadcast.RoomID, clients, client, broadcast.Message)
 				}
 			} else {
 				log.Printf("✗ Room %d not found in hub (no clients connected)\n", broadcast.RoomID)
@@ -144,6 +167,44 @@ func (h *Hub) Run() {
 	}
 }
 
+// deliver queues a message for a client, dropping the client if it can't keep up.
+// Called from Run with h.mu held.
+func (h *Hub) deliver(roomID uint, clients map[*Client]bool, client *Client, message []byte) {
+	select {
+	case client.Send <- message:
+		log.Printf("  ✓ Sent to client %d in room %d\n", client.ID, roomID)
+	default:
+		// Client's send channel is full, close and remove
+		log.Printf("  ✗ Client %d send channel FULL - removing from room %d\n", client.ID, roomID)
+		close(client.Send)
+		delete(clients, client)
+	}
+}
+
+// evict removes a client from its room and queues a nil message, on which
+// the write pump flushes what came before and closes the connection. The
+// send channel stays open as the read pump may still answer the client.
+// Called from Run with h.mu held.
+func (h *Hub) evict(roomID uint, client *Client) {
+	clients, ok := h.Rooms[roomID]
+	if !ok {
+		return
+	}
+	if _, ok := clients[client]; !ok {
+		return
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(h.Rooms, roomID)
+	}
+
+	select {
+	case client.Send <- nil:
+	default:
+		client.Conn.Close()
+	}
+}
+
 // broadcastUserJoined notifies room that a user joined
 func (h *Hub) broadcastUserJoined(client *Client) {
 	msg := Message{
@@ -247,35 +308,45 @@ func (c *Client) ReadPump() {
 			}
 			continue
 
-		case "message", "chat":
-			// Save to DB first
-			message := models.Message{
-				RoomID:   c.RoomID,
-				SenderID: c.ID,
-				Content:  msg.Content.(string), // type assertion
-			}
-			if err := config.DB.Create(&message).Error; err != nil {
-				log.Printf("Failed to save message: %v", err)
+		case "read":
+			// Move the read cursor, the receipt is broadcast by the service
+			if c.ReadOnly {
 				continue
 			}
+			if _, err := NewChatService().MarkRoomRead(c.RoomID, c.ID, msg.MessageID); err != nil {
+				log.Printf("Failed to mark room %d read for client %d: %v", c.RoomID, c.ID, err)
+			}
+			continue
 
-			// Preload sender information
-			config.DB.Preload("Sender").First(&message, message.ID)
+		case "message", "chat":
+			if c.ReadOnly {
+				log.Printf("Client %d is read-only, dropping message in room %d", c.ID, c.RoomID)
+				continue
+			}
 
-			// Create the proper WebSocket response structure matching frontend expectations
-			wsResponse := map[string]interface{}{
-				"type":    "message",
-				"message": message,
+			// Content may be left out when sending attachments only
+			content, ok := msg.Content.(string)
+			if !ok && msg.Content != nil {
+				log.Printf("Invalid message content from client %d", c.ID)
+				continue
 			}
 
-			if data, err := json.Marshal(wsResponse); err == nil {
-				c.Hub.Broadcast <- &BroadcastMessage{
-					RoomID:  c.RoomID,
-					Message: data,
-				}
-				log.Printf("Broadcasted message %d to room %d", message.ID, c.RoomID)
-			} else {
-				log.Printf("Failed to marshal message response: %v", err)
+			// Same path as REST: saves, updates the thread and broadcasts
+			if _, err := NewChatService().SendMessage(SendMessageParams{
+				RoomID:        c.RoomID,
+				SenderID:      c.ID,
+				Content:       content,
+				ParentID:      msg.ParentID,
+				AttachmentIDs: msg.AttachmentIDs,
+			}); err != nil {
+				log.Printf("Failed to save message from client %d: %v", c.ID, err)
+
+				// Tell the sender why, e.g. slow mode or an admins-only room
+				c.Hub.SendToClient(c, Message{
+					Type:      "error",
+					Content:   err.Error(),
+					Timestamp: time.Now(),
+				})
 			}
 
 		default:
@@ -306,8 +377,8 @@ func (c *Client) WritePump() {
 		select {
 		case message, ok := <-c.Send:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel
+			if !ok || message == nil {
+				// The hub closed the channel or evicted the client
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
@@ -319,15 +390,25 @@ func (c *Client) WritePump() {
 			w.Write(message)
 
 			// Add queued messages to the current websocket message
+			evicted := false
 			n := len(c.Send)
 			for i := 0; i < n; i++ {
+				queued := <-c.Send
+				if queued == nil {
+					evicted = true
+					break
+				}
 				w.Write([]byte{'\n'})
-				w.Write(<-c.Send)
+				w.Write(queued)
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
+			if evicted {
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
 
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -362,3 +443,95 @@ func (h *Hub) GetRoomClientCount(roomID uint) int {
 	}
 	return 0
 }
+
+// DisconnectSession closes every connection opened with the given login session.
+// The read pump then unregisters the client as for any other disconnect.
+func (h *Hub) DisconnectSession(sessionID uint) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, clients := range h.Rooms {
+		for client := range clients {
+			if client.SessionID == sessionID {
+				log.Printf("Closing connection of client %d in room %d (session %d revoked)", client.ID, client.RoomID, sessionID)
+				client.Conn.Close()
+			}
+		}
+	}
+}
+
+// DisconnectAPIKey closes every connection opened with the given API key
+func (h *Hub) DisconnectAPIKey(keyID uint) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, clients := range h.Rooms {
+		for client := range clients {
+			if client.APIKeyID == keyID {
+				log.Printf("Closing connection of client %d in room %d (api key %d signed out)", client.ID, client.RoomID, keyID)
+				client.Conn.Close()
+			}
+		}
+	}
+}
+
+// DisconnectRoomMember sends a last event to the user's connections to a room
+// they no longer belong to, then closes them
+func (h *Hub) DisconnectRoomMember(roomID, userID uint, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event for user %d: %v", userID, err)
+		return
+	}
+
+	// Blocking send: dropping this would leave the user connected
+	h.Broadcast <- &BroadcastMessage{RoomID: roomID, UserID: userID, Message: data, Close: true}
+}
+
+// SendToUser sends a JSON event to every connection of the user, in any room,
+// without blocking the caller when the hub is busy
+func (h *Hub) SendToUser(userID uint, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event for user %d: %v", userID, err)
+		return
+	}
+
+	select {
+	case h.Broadcast <- &BroadcastMessage{UserID: userID, Message: data}:
+	default:
+		log.Printf("Failed to send event to user %d (channel full)", userID)
+	}
+}
+
+// SendToClient sends a JSON event to a single connection without blocking
+// the caller when the hub is busy
+func (h *Hub) SendToClient(client *Client, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event for client %d: %v", client.ID, err)
+		return
+	}
+
+	select {
+	case h.Broadcast <- &BroadcastMessage{Client: client, Message: data}:
+	default:
+		log.Printf("Failed to send event to client %d (channel full)", client.ID)
+	}
+}
+
+// BroadcastEvent sends a JSON event to every client of the room without
+// blocking the caller when the hub is busy
+func (h *Hub) BroadcastEvent(roomID uint, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event for room %d: %v", roomID, err)
+		return
+	}
+
+	select {
+	case h.Broadcast <- &BroadcastMessage{RoomID: roomID, Message: data}:
+	default:
+		log.Printf("Failed to broadcast event to room %d (channel full)", roomID)
+	}
+}
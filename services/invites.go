@@ -0,0 +1,211 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// maxInviteTTL caps how far in the future an invite may expire
+const maxInviteTTL = 30 * 24 * time.Hour
+
+// InviteOptions are the limits of a new invite, zero values mean none
+type InviteOptions struct {
+	ExpiresIn time.Duration
+	MaxUses   int
+}
+
+// InvitePreview is what anyone holding an invite code may see of the room
+type InvitePreview struct {
+	Code        string     `json:"code"`
+	RoomID      uint       `json:"room_id"`
+	RoomName    string     `json:"room_name"`
+	Topic       string     `json:"topic"`
+	AvatarURL   string     `json:"avatar_url"`
+	MemberCount int64      `json:"member_count"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	IsMember    bool       `json:"is_member"`
+}
+
+// CreateInvite creates an invite link to a group room, for members allowed
+// to add people to it
+func (s *ChatService) CreateInvite(roomID, userID uint, options InviteOptions) (*models.RoomInvite, error) {
+	room, err := groupRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	member, err := roomMember(roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !canAddMembers(room, member) {
+		return nil, errors.New("access denied")
+	}
+	if options.ExpiresIn < 0 || options.ExpiresIn > maxInviteTTL || options.MaxUses < 0 {
+		return nil, errors.New("invalid invite options")
+	}
+
+	code, err := utils.RandomToken(12)
+	if err != nil {
+		return nil, errors.New("failed to create invite")
+	}
+	invite := models.RoomInvite{
+		RoomID:      roomID,
+		Code:        code,
+		CreatedByID: userID,
+		MaxUses:     options.MaxUses,
+	}
+	if options.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(options.ExpiresIn)
+		invite.ExpiresAt = &expiresAt
+	}
+	if err := config.DB.Create(&invite).Error; err != nil {
+		return nil, errors.New("failed to create invite")
+	}
+	return &invite, nil
+}
+
+// GetRoomInvites lists the room's invites, newest first, with who joined
+// through each of them. Only room admins see them.
+func (s *ChatService) GetRoomInvites(roomID, userID uint) ([]models.RoomInvite, error) {
+	if _, err := groupRoom(roomID); err != nil {
+		return nil, err
+	}
+	if !isRoomAdmin(roomID, userID) {
+		return nil, errors.New("access denied")
+	}
+
+	invites := []models.RoomInvite{}
+	if err := config.DB.
+		Preload("Joins", func(tx *gorm.DB) *gorm.DB { return tx.Order("joined_at") }).
+		Preload("Joins.User", func(tx *gorm.DB) *gorm.DB { return tx.Unscoped() }).
+		Where("room_id = ?", roomID).
+		Order("id DESC").
+		Find(&invites).Error; err != nil {
+		return nil, errors.New("failed to retrieve invites")
+	}
+	return invites, nil
+}
+
+// RevokeInvite disables an invite. Room admins may revoke any invite of the
+// room, members their own.
+func (s *ChatService) RevokeInvite(code string, userID uint) error {
+	invite, err := findInvite(code)
+	if err != nil {
+		return err
+	}
+	if invite.CreatedByID != userID && !isRoomAdmin(invite.RoomID, userID) {
+		return errors.New("access denied")
+	}
+	if invite.RevokedAt != nil {
+		return nil
+	}
+
+	if err := config.DB.Model(invite).Update("revoked_at", time.Now()).Error; err != nil {
+		return errors.New("failed to revoke invite")
+	}
+	return nil
+}
+
+// PreviewInvite describes the room an invite leads to
+func (s *ChatService) PreviewInvite(code string, userID uint) (*InvitePreview, error) {
+	invite, err := findInvite(code)
+	if err != nil {
+		return nil, err
+	}
+	if !invite.Usable(time.Now()) {
+		return nil, errors.New("invite expired")
+	}
+
+	var room models.ChatRoom
+	if err := config.DB.First(&room, invite.RoomID).Error; err != nil {
+		return nil, errors.New("invite not found")
+	}
+
+	preview := InvitePreview{
+		Code:      invite.Code,
+		RoomID:    room.ID,
+		RoomName:  room.Name,
+		Topic:     room.Topic,
+		AvatarURL: room.AvatarURL,
+		ExpiresAt: invite.ExpiresAt,
+		IsMember:  isRoomMember(room.ID, userID),
+	}
+	config.DB.Model(&models.RoomMember{}).Where("room_id = ?", room.ID).Count(&preview.MemberCount)
+	return &preview, nil
+}
+
+// JoinWithInvite adds the user to the invite's room. Joining a room the user
+// is already in does not use the invite up.
+func (s *ChatService) JoinWithInvite(code string, userID uint) (*models.ChatRoom, error) {
+	invite, err := findInvite(code)
+	if err != nil {
+		return nil, err
+	}
+	room, err := groupRoom(invite.RoomID)
+	if err != nil {
+		return nil, errors.New("invite not found")
+	}
+	if isRoomMember(room.ID, userID) {
+		return room, nil
+	}
+	if !invite.Usable(time.Now()) {
+		return nil, errors.New("invite expired")
+	}
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		// Conditional update so concurrent joins can't exceed MaxUses or
+		// slip in past the expiry. The creator must still be allowed to add
+		// members, so links die with their creator's membership or role.
+		result := tx.Model(&models.RoomInvite{}).
+			Where("id = ? AND revoked_at IS NULL AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > ?)", invite.ID, time.Now()).
+			Where(`EXISTS (SELECT 1 FROM room_members
+				JOIN chat_rooms ON chat_rooms.id = room_members.room_id
+				WHERE room_members.room_id = room_invites.room_id AND room_members.user_id = room_invites.created_by_id
+				AND (room_members.role IN ? OR chat_rooms.setting_add_member_policy = ?))`,
+				[]string{models.RoomRoleOwner, models.RoomRoleAdmin}, models.RoomPolicyMembers).
+			Update("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("invite expired")
+		}
+
+		if err := tx.Create(&models.RoomMember{RoomID: room.ID, UserID: userID, Role: models.RoomRoleMember}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.RoomInviteJoin{InviteID: invite.ID, RoomID: room.ID, UserID: userID}).Error
+	})
+	if err != nil {
+		if err.Error() == "invite expired" {
+			return nil, err
+		}
+		return nil, errors.New("failed to join room")
+	}
+
+	config.DB.Preload("Members").Preload("Creator").First(room, room.ID)
+
+	postSystemMessage(room.ID, userID, fmt.Sprintf("%s joined with an invite link", displayName(userID)))
+	GetHub().BroadcastEvent(room.ID, map[string]interface{}{
+		"type":      "member_added",
+		"room_id":   room.ID,
+		"user_id":   userID,
+		"invite_id": invite.ID,
+		"timestamp": time.Now(),
+	})
+	return room, nil
+}
+
+func findInvite(code string) (*models.RoomInvite, error) {
+	var invite models.RoomInvite
+	if code == "" || config.DB.Where("code = ?", code).First(&invite).Error != nil {
+		return nil, errors.New("invite not found")
+	}
+	return &invite, nil
+}
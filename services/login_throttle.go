@@ -0,0 +1,214 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginAttempts is the failure history of one throttling key (an account or an IP)
+type LoginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// LoginAttemptStore keeps failed login counters. Entries expire after the
+// window passed to RecordFailure; implementations must be safe for concurrent use.
+type LoginAttemptStore interface {
+	Get(key string) LoginAttempts
+	RecordFailure(key string, window time.Duration) LoginAttempts
+	Reset(key string)
+}
+
+// LoginLockedError is returned while an account or IP is locked out
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// LoginThrottle applies exponential backoff once an account or an IP
+// exceeds its allowed number of failed logins
+type LoginThrottle struct {
+	store LoginAttemptStore
+
+	// Failures allowed before the lockout starts
+	AccountLimit int
+	IPLimit      int
+
+	// The first lockout lasts BaseDelay and doubles with every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Counters are forgotten after Window without failures
+	Window time.Duration
+}
+
+var loginThrottleInstance *LoginThrottle
+var loginThrottleOnce sync.Once
+
+// GetLoginThrottle returns the throttle configured through LOGIN_* env variables
+func GetLoginThrottle() *LoginThrottle {
+	loginThrottleOnce.Do(func() {
+		if loginThrottleInstance == nil {
+			loginThrottleInstance = newLoginThrottleFromEnv(NewMemoryLoginAttemptStore())
+		}
+	})
+	return loginThrottleInstance
+}
+
+// SetLoginThrottle replaces the throttle, e.g. to use a shared store
+func SetLoginThrottle(t *LoginThrottle) {
+	loginThrottleOnce.Do(func() {})
+	loginThrottleInstance = t
+}
+
+func NewLoginThrottle(store LoginAttemptStore) *LoginThrottle {
+	return &LoginThrottle{
+		store:        store,
+		AccountLimit: 5,
+		IPLimit:      50,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     15 * time.Minute,
+		Window:       time.Hour,
+	}
+}
+
+func newLoginThrottleFromEnv(store LoginAttemptStore) *LoginThrottle {
+	t := NewLoginThrottle(store)
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_MAX_ATTEMPTS")); err == nil && n > 0 {
+		t.AccountLimit = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_IP_MAX_ATTEMPTS")); err == nil && n > 0 {
+		t.IPLimit = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_BASE")); err == nil && d > 0 {
+		t.BaseDelay = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_MAX")); err == nil && d > 0 {
+		t.MaxDelay = d
+	}
+	return t
+}
+
+// Check returns a LoginLockedError if the account or the IP is locked out
+func (t *LoginThrottle) Check(email, ip string) error {
+	retryAfter := t.lockedFor(t.store.Get(accountKey(email)), t.AccountLimit)
+	if ip != "" {
+		if d := t.lockedFor(t.store.Get(ipKey(ip)), t.IPLimit); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// Failure records a failed attempt against both the account and the IP
+func (t *LoginThrottle) Failure(email, ip string) {
+	t.store.RecordFailure(accountKey(email), t.Window)
+	if ip != "" {
+		t.store.RecordFailure(ipKey(ip), t.Window)
+	}
+}
+
+// Success clears the account counter. The IP counter is left alone so that
+// a valid login doesn't unlock guessing against other accounts.
+func (t *LoginThrottle) Success(email string) {
+	t.store.Reset(accountKey(email))
+}
+
+// lockedFor returns how long the key stays locked, 0 if it isn't
+func (t *LoginThrottle) lockedFor(attempts LoginAttempts, limit int) time.Duration {
+	if attempts.Failures < limit {
+		return 0
+	}
+
+	delay := t.BaseDelay
+	for i := limit; i < attempts.Failures && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+
+	return time.Until(attempts.LastFailure.Add(delay))
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return fmt.Sprintf("ip:%s", ip)
+}
+
+// MemoryLoginAttemptStore keeps counters in process memory
+type MemoryLoginAttemptStore struct {
+	mu        sync.Mutex
+	attempts  map[string]memoryLoginAttempts
+	lastPrune time.Time
+}
+
+type memoryLoginAttempts struct {
+	LoginAttempts
+	expiresAt time.Time
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: make(map[string]memoryLoginAttempts)}
+}
+
+func (s *MemoryLoginAttemptStore) Get(key string) LoginAttempts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.attempts[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return LoginAttempts{}
+	}
+	return entry.LoginAttempts
+}
+
+func (s *MemoryLoginAttemptStore) RecordFailure(key string, window time.Duration) LoginAttempts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := s.attempts[key]
+	if !ok || now.After(entry.expiresAt) {
+		entry = memoryLoginAttempts{}
+		s.pruneLocked(now)
+	}
+	entry.Failures++
+	entry.LastFailure = now
+	entry.expiresAt = now.Add(window)
+	s.attempts[key] = entry
+	return entry.LoginAttempts
+}
+
+func (s *MemoryLoginAttemptStore) Reset(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+}
+
+// pruneLocked drops expired entries, at most once a minute, so the map
+// doesn't grow without bound
+func (s *MemoryLoginAttemptStore) pruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+	for key, entry := range s.attempts {
+		if now.After(entry.expiresAt) {
+			delete(s.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends transactional emails (password reset, email verification)
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// Mail is a single email captured by the file and in-memory mailers
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+	SentAt  time.Time
+}
+
+var mailerInstance Mailer
+var mailerOnce sync.Once
+
+// GetMailer returns the mailer configured through MAIL_DRIVER (smtp, file or memory)
+func GetMailer() Mailer {
+	mailerOnce.Do(func() {
+		if mailerInstance == nil {
+			mailerInstance = newMailerFromEnv()
+		}
+	})
+	return mailerInstance
+}
+
+// SetMailer replaces the mailer, e.g. with a MemoryMailer in tests
+func SetMailer(m Mailer) {
+	mailerOnce.Do(func() {})
+	mailerInstance = m
+}
+
+func newMailerFromEnv() Mailer {
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+	case "memory":
+		return NewMemoryMailer()
+	default:
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		log.Printf("Mail driver not configured, writing emails to %s", dir)
+		return &FileMailer{Dir: dir}
+	}
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	port := m.Port
+	if port == "" {
+		port = "587"
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(m.Host+":"+port, auth, m.From, []string{to}, formatMail(m.From, to, subject, body))
+}
+
+// FileMailer writes every email as a .eml file into Dir
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(to))
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMail("noreply@localhost", to, subject, body), 0o644)
+}
+
+// MemoryMailer keeps sent emails in memory
+type MemoryMailer struct {
+	mu    sync.Mutex
+	mails []Mail
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mails = append(m.mails, Mail{To: to, Subject: subject, Body: body, SentAt: time.Now()})
+	return nil
+}
+
+// Sent returns every email sent so far
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.mails...)
+}
+
+// LastTo returns the most recent email sent to an address
+func (m *MemoryMailer) LastTo(to string) (Mail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.mails) - 1; i >= 0; i-- {
+		if m.mails[i].To == to {
+			return m.mails[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+func formatMail(from, to, subject, body string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n")
+}
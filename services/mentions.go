@@ -0,0 +1,235 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// mentionPattern finds @name not preceded by a word character, so email
+// addresses don't count as mentions
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.@])@([A-Za-z0-9_.]+)`)
+
+// reservedUsernames are mention keywords no account may take as username
+var reservedUsernames = map[string]bool{
+	models.MentionRoom: true,
+	models.MentionHere: true,
+}
+
+// MentionQuery selects a page of the user's mentions, newest first. Only
+// unread ones unless All is set.
+type MentionQuery struct {
+	RoomID uint
+	Before uint
+	Limit  int
+	All    bool
+}
+
+// MentionPage is a page of the mentions inbox
+type MentionPage struct {
+	Mentions   []models.Mention `json:"mentions"`
+	NextCursor *uint            `json:"next_cursor"`
+	HasMore    bool             `json:"has_more"`
+}
+
+// parseMentions returns the lowercased usernames mentioned in content and
+// whether it mentions @room or @here
+func parseMentions(content string) (usernames []string, room, here bool) {
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// A trailing dot ends the sentence, not the username
+		name := strings.ToLower(strings.TrimRight(match[1], "."))
+		switch {
+		case name == models.MentionRoom:
+			room = true
+		case name == models.MentionHere:
+			here = true
+		case name != "" && !seen[name]:
+			seen[name] = true
+			usernames = append(usernames, name)
+		}
+	}
+	return usernames, room, here
+}
+
+// resolveMentions turns the mentions in a message into records for the
+// members of its room, the sender excluded. A direct mention wins over
+// @here, which wins over @room.
+func resolveMentions(tx *gorm.DB, message *models.Message) ([]models.Mention, error) {
+	usernames, room, here := parseMentions(message.Content)
+	if len(usernames) == 0 && !room && !here {
+		return nil, nil
+	}
+
+	var members []struct {
+		ID       uint
+		Username string
+		IsOnline bool
+	}
+	if err := tx.Table("users").
+		Select("users.id, users.username, users.is_online").
+		Joins("JOIN room_members ON room_members.user_id = users.id").
+		Where("room_members.room_id = ? AND users.id <> ? AND users.deleted_at IS NULL", message.RoomID, message.SenderID).
+		Scan(&members).Error; err != nil {
+		return nil, err
+	}
+
+	direct := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		direct[username] = true
+	}
+
+	var mentions []models.Mention
+	for _, member := range members {
+		kind := ""
+		switch {
+		case direct[strings.ToLower(member.Username)]:
+			kind = models.MentionUser
+		case here && member.IsOnline:
+			kind = models.MentionHere
+		case room:
+			kind = models.MentionRoom
+		default:
+			continue
+		}
+		mentions = append(mentions, models.Mention{
+			MessageID: message.ID,
+			UserID:    member.ID,
+			RoomID:    message.RoomID,
+			SenderID:  message.SenderID,
+			Kind:      kind,
+		})
+	}
+	return mentions, nil
+}
+
+// syncMentions stores the mentions of a new or edited message and returns
+// those that are new, to be notified. Members no longer mentioned after an
+// edit lose their record.
+func syncMentions(tx *gorm.DB, message *models.Message) ([]models.Mention, error) {
+	mentions, err := resolveMentions(tx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing []models.Mention
+	if err := tx.Where("message_id = ?", message.ID).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	previous := make(map[uint]bool, len(existing))
+	for _, mention := range existing {
+		previous[mention.UserID] = true
+	}
+
+	current := make([]uint, 0, len(mentions))
+	var added []models.Mention
+	for _, mention := range mentions {
+		current = append(current, mention.UserID)
+		if !previous[mention.UserID] {
+			added = append(added, mention)
+		}
+	}
+
+	removed := tx.Where("message_id = ?", message.ID)
+	if len(current) > 0 {
+		removed = removed.Where("user_id NOT IN ?", current)
+	}
+	if err := removed.Delete(&models.Mention{}).Error; err != nil {
+		return nil, err
+	}
+	if len(added) > 0 {
+		if err := tx.Create(&added).Error; err != nil {
+			return nil, err
+		}
+	}
+	return added, nil
+}
+
+// notifyMentions delivers a "mention" event to each mentioned user on every
+// connection they have open, not only the room of the message
+func notifyMentions(mentions []models.Mention, message *models.Message) {
+	hub := GetHub()
+	for _, mention := range mentions {
+		hub.SendToUser(mention.UserID, map[string]interface{}{
+			"type":       "mention",
+			"mention_id": mention.ID,
+			"kind":       mention.Kind,
+			"room_id":    message.RoomID,
+			"message":    message,
+			"timestamp":  time.Now(),
+		})
+	}
+}
+
+// GetMentions returns the user's mentions inbox, in rooms they still belong
+// to. A mention is read once the room's read cursor passed its message.
+func (s *ChatService) GetMentions(userID uint, q MentionQuery) (*MentionPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultMessagePageSize
+	}
+	if q.Limit > maxMessagePageSize {
+		q.Limit = maxMessagePageSize
+	}
+
+	query := config.DB.
+		Select("mentions.*").
+		Joins("JOIN room_members ON room_members.room_id = mentions.room_id AND room_members.user_id = mentions.user_id").
+		Joins("JOIN messages ON messages.id = mentions.message_id AND messages.deleted_at IS NULL").
+		Where("mentions.user_id = ?", userID)
+	if !q.All {
+		query = query.Where("mentions.message_id > room_members.last_read_message_id")
+	}
+	if q.RoomID != 0 {
+		query = query.Where("mentions.room_id = ?", q.RoomID)
+	}
+	if q.Before != 0 {
+		query = query.Where("mentions.id < ?", q.Before)
+	}
+
+	page := &MentionPage{}
+	if err := query.Order("mentions.id DESC").Limit(q.Limit + 1).Find(&page.Mentions).Error; err != nil {
+		return nil, errors.New("failed to retrieve mentions")
+	}
+	if len(page.Mentions) > q.Limit {
+		page.Mentions, page.HasMore = page.Mentions[:q.Limit], true
+	}
+	if len(page.Mentions) == 0 {
+		page.Mentions = []models.Mention{}
+		return page, nil
+	}
+
+	messageIDs := make([]uint, len(page.Mentions))
+	for i, mention := range page.Mentions {
+		messageIDs[i] = mention.MessageID
+	}
+	var messages []models.Message
+	if err := config.DB.Scopes(models.PreloadSender).Where("id IN ?", messageIDs).Find(&messages).Error; err != nil {
+		return nil, errors.New("failed to retrieve mentions")
+	}
+	byID := make(map[uint]*models.Message, len(messages))
+	for i := range messages {
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	var members []models.RoomMember
+	config.DB.Select("room_id, last_read_message_id").Where("user_id = ?", userID).Find(&members)
+	readCursors := make(map[uint]uint, len(members))
+	for _, member := range members {
+		readCursors[member.RoomID] = member.LastReadMessageID
+	}
+
+	for i := range page.Mentions {
+		mention := &page.Mentions[i]
+		mention.Message = byID[mention.MessageID]
+		mention.IsRead = mention.MessageID <= readCursors[mention.RoomID]
+	}
+	if page.HasMore {
+		page.NextCursor = &page.Mentions[len(page.Mentions)-1].ID
+	}
+	return page, nil
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// mfaPendingTTL is how long the user has to enter a code after the password step
+	mfaPendingTTL = 5 * time.Minute
+
+	// mfaMaxAttempts wrong codes burn the pending token and force a new login
+	mfaMaxAttempts = 5
+
+	recoveryCodeCount = 10
+)
+
+type MFAService struct {
+	sessionService *SessionService
+	throttle       *LoginThrottle
+}
+
+func NewMFAService() *MFAService {
+	return &MFAService{
+		sessionService: NewSessionService(),
+		throttle:       GetLoginThrottle(),
+	}
+}
+
+// SetupTOTP generates a new secret for the user. It only takes effect once
+// confirmed with EnableTOTP.
+func (s *MFAService) SetupTOTP(userID uint) (string, string, error) {
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		return "", "", errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return "", "", errors.New("mfa already enabled")
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", errors.New("failed to generate secret")
+	}
+	if err := config.DB.Model(&user).Update("totp_secret", secret).Error; err != nil {
+		return "", "", errors.New("failed to save secret")
+	}
+
+	return secret, utils.TOTPProvisioningURI(mfaIssuer(), user.Email, secret), nil
+}
+
+// EnableTOTP confirms the pending secret with a code from the authenticator
+// and returns a fresh set of recovery codes
+func (s *MFAService) EnableTOTP(userID uint, code string) ([]string, error) {
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return nil, errors.New("mfa already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return nil, errors.New("mfa setup not started")
+	}
+
+	counter, ok := utils.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, errors.New("invalid code")
+	}
+
+	var codes []string
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled":      true,
+			"totp_last_counter": counter,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("failed to enable mfa")
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP turns MFA off after checking the password and a current code
+func (s *MFAService) DisableTOTP(userID uint, password, code string) error {
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if !user.TOTPEnabled {
+		return errors.New("mfa not enabled")
+	}
+	if !user.CheckPassword(password) {
+		return errors.New("invalid password")
+	}
+	if !s.checkCode(&user, code) {
+		return errors.New("invalid code")
+	}
+
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled":      false,
+			"totp_secret":       "",
+			"totp_last_counter": 0,
+		}).Error; err != nil {
+			return errors.New("failed to disable mfa")
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// IssuePendingToken returns the short-lived token handed out after the password step
+func (s *MFAService) IssuePendingToken(userID uint) (string, error) {
+	return issueActionToken(userID, purposeMFAPending, mfaPendingTTL)
+}
+
+// VerifyLogin exchanges a pending token and a TOTP or recovery code for a full session
+func (s *MFAService) VerifyLogin(mfaToken, code string, device DeviceInfo) (*models.User, *TokenPair, error) {
+	record, err := checkActionToken(mfaToken, purposeMFAPending)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, record.UserID).Error; err != nil {
+		return nil, nil, errors.New("user not found")
+	}
+
+	// Wrong codes count against the account like wrong passwords
+	if err := s.throttle.Check(user.Email, device.IP); err != nil {
+		recordFailedLogin(&user.ID, user.Email, device, "locked")
+		return nil, nil, err
+	}
+	if err := claimActionTokenAttempt(record, mfaMaxAttempts); err != nil {
+		return nil, nil, err
+	}
+	if !s.checkCode(&user, code) {
+		failActionToken(record, mfaMaxAttempts)
+		s.throttle.Failure(user.Email, device.IP)
+		recordFailedLogin(&user.ID, user.Email, device, "wrong_mfa_code")
+		return nil, nil, errors.New("invalid code")
+	}
+	if err := useActionToken(record); err != nil {
+		return nil, nil, err
+	}
+	s.throttle.Success(user.Email)
+
+	tokens, err := s.sessionService.CreateSession(&user, device)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, tokens, nil
+}
+
+// checkCode accepts a TOTP code (each time step only once) or an unused recovery code
+func (s *MFAService) checkCode(user *models.User, code string) bool {
+	if counter, ok := utils.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		// Conditional update rejects replaying a code that was already accepted
+		result := config.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_counter < ?", user.ID, counter).
+			Update("totp_last_counter", counter)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	result := config.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, utils.HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and generates new ones
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secret[:5] + "-" + secret[5:10])
+		if err := tx.Create(&models.RecoveryCode{
+			UserID:   userID,
+			CodeHash: utils.HashToken(normalizeRecoveryCode(code)),
+		}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
+
+func mfaIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "my-ecomm"
+}
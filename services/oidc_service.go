@@ -0,0 +1,473 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCStateTTL is how long a user has to complete the login at the provider
+const OIDCStateTTL = 10 * time.Minute
+
+// OIDCProvider is an OpenID Connect identity provider configured through
+// OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and _SCOPES
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]interface{}
+}
+
+// OIDCIdentity is the verified identity returned by a provider
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcAuthRequest is what we remember between /start and /callback
+type oidcAuthRequest struct {
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	ExpiresAt    time.Time
+}
+
+type oidcIDTokenClaims struct {
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Name          string      `json:"name"`
+	Nonce         string      `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+type OIDCService struct {
+	providers      map[string]*OIDCProvider
+	httpClient     *http.Client
+	sessionService *SessionService
+	mfaService     *MFAService
+
+	mu      sync.Mutex
+	pending map[string]*oidcAuthRequest // state -> request
+}
+
+var oidcInstance *OIDCService
+var oidcOnce sync.Once
+
+// GetOIDCService returns the singleton configured from the environment
+func GetOIDCService() *OIDCService {
+	oidcOnce.Do(func() {
+		oidcInstance = NewOIDCService(LoadOIDCProvidersFromEnv(), &http.Client{Timeout: 10 * time.Second})
+	})
+	return oidcInstance
+}
+
+// NewOIDCService creates a service for the given providers, e.g. a local stub issuer in tests
+func NewOIDCService(providers map[string]*OIDCProvider, httpClient *http.Client) *OIDCService {
+	return &OIDCService{
+		providers:      providers,
+		httpClient:     httpClient,
+		sessionService: NewSessionService(),
+		mfaService:     NewMFAService(),
+		pending:        make(map[string]*oidcAuthRequest),
+	}
+}
+
+// LoadOIDCProvidersFromEnv reads the providers listed in OIDC_PROVIDERS (comma separated)
+func LoadOIDCProvidersFromEnv() map[string]*OIDCProvider {
+	providers := make(map[string]*OIDCProvider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		scopes := strings.Fields(os.Getenv(prefix + "SCOPES"))
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+
+		provider := &OIDCProvider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       scopes,
+		}
+		if provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+			log.Printf("OIDC provider %q is missing ISSUER, CLIENT_ID or REDIRECT_URL, skipping", name)
+			continue
+		}
+		providers[name] = provider
+	}
+	return providers
+}
+
+// AuthorizationURL starts an authorization code + PKCE flow and returns the
+// URL to send the user to, along with the state the callback has to carry.
+// The caller binds the state to the browser so the callback can't be replayed
+// in another one.
+func (s *OIDCService) AuthorizationURL(providerName string) (string, string, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return "", "", errors.New("unknown provider")
+	}
+
+	discovery, err := s.discover(provider)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := utils.RandomToken(24)
+	if err != nil {
+		return "", "", errors.New("failed to start login")
+	}
+	nonce, err := utils.RandomToken(24)
+	if err != nil {
+		return "", "", errors.New("failed to start login")
+	}
+	verifier, err := utils.RandomToken(32)
+	if err != nil {
+		return "", "", errors.New("failed to start login")
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for key, req := range s.pending {
+		if now.After(req.ExpiresAt) {
+			delete(s.pending, key)
+		}
+	}
+	s.pending[state] = &oidcAuthRequest{
+		Provider:     providerName,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    now.Add(OIDCStateTTL),
+	}
+	s.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.ClientID)
+	params.Set("redirect_uri", provider.RedirectURL)
+	params.Set("scope", strings.Join(provider.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), state, nil
+}
+
+// Exchange completes the flow: it redeems the code and verifies the ID token
+func (s *OIDCService) Exchange(providerName, code, state string) (*OIDCIdentity, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return nil, errors.New("unknown provider")
+	}
+
+	// State is single use
+	s.mu.Lock()
+	req, ok := s.pending[state]
+	delete(s.pending, state)
+	s.mu.Unlock()
+
+	if !ok || req.Provider != providerName || time.Now().After(req.ExpiresAt) {
+		return nil, errors.New("invalid or expired state")
+	}
+
+	discovery, err := s.discover(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.RedirectURL)
+	form.Set("client_id", provider.ClientID)
+	form.Set("code_verifier", req.CodeVerifier)
+	if provider.ClientSecret != "" {
+		form.Set("client_secret", provider.ClientSecret)
+	}
+
+	resp, err := s.httpClient.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return nil, errors.New("failed to reach identity provider")
+	}
+	defer resp.Body.Close()
+
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("OIDC token exchange with %s failed: status %d, error %q", providerName, resp.StatusCode, tokenResponse.Error)
+		return nil, errors.New("code exchange failed")
+	}
+	if tokenResponse.IDToken == "" {
+		return nil, errors.New("code exchange failed")
+	}
+
+	claims, err := s.verifyIDToken(provider, discovery, tokenResponse.IDToken)
+	if err != nil {
+		log.Printf("OIDC id_token from %s rejected: %v", providerName, err)
+		return nil, errors.New("invalid id token")
+	}
+	if claims.Nonce != req.Nonce {
+		return nil, errors.New("invalid id token")
+	}
+
+	return &OIDCIdentity{
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+		Name:          claims.Name,
+	}, nil
+}
+
+// Login completes the flow and signs in the linked user, creating or linking
+// an account by verified email on first use
+func (s *OIDCService) Login(providerName, code, state string, device DeviceInfo) (*LoginResult, error) {
+	identity, err := s.Exchange(providerName, code, state)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.findOrCreateUser(providerName, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.TOTPEnabled {
+		mfaToken, err := s.mfaService.IssuePendingToken(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{User: user, MFAToken: mfaToken}, nil
+	}
+
+	tokens, err := s.sessionService.CreateSession(user, device)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: user, Tokens: tokens}, nil
+}
+
+func (s *OIDCService) findOrCreateUser(providerName string, identity *OIDCIdentity) (*models.User, error) {
+	var user models.User
+
+	// Returning user
+	var link models.UserIdentity
+	if err := config.DB.Where("provider = ? AND subject = ?", providerName, identity.Subject).First(&link).Error; err == nil {
+		if err := config.DB.First(&user, link.UserID).Error; err != nil {
+			return nil, errors.New("user not found")
+		}
+		return &user, nil
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, errors.New("provider did not return a verified email")
+	}
+
+	now := time.Now()
+	if err := config.DB.Where("email = ?", identity.Email).First(&user).Error; err == nil {
+		// Linking to an unverified local account would hand it to whoever registered it
+		if user.EmailVerifiedAt == nil {
+			return nil, errors.New("an account with this email exists; verify it before signing in with " + providerName)
+		}
+	} else {
+		// No password: the account can only sign in through the provider
+		// until the user sets one with the reset flow
+		name := identity.Name
+		if name == "" {
+			name = strings.Split(identity.Email, "@")[0]
+		}
+		user = models.User{
+			Email:           identity.Email,
+			Name:            name,
+			Username:        GenerateUsername(identity.Email),
+			EmailVerifiedAt: &now,
+		}
+		if err := config.DB.Create(&user).Error; err != nil {
+			return nil, errors.New("failed to create user")
+		}
+	}
+
+	link = models.UserIdentity{
+		UserID:   user.ID,
+		Provider: providerName,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+	if err := config.DB.Create(&link).Error; err != nil {
+		return nil, errors.New("failed to link account")
+	}
+
+	return &user, nil
+}
+
+func (s *OIDCService) discover(provider *OIDCProvider) (*oidcDiscovery, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+
+	resp, err := s.httpClient.Get(provider.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, errors.New("failed to reach identity provider")
+	}
+	defer resp.Body.Close()
+
+	var discovery oidcDiscovery
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&discovery) != nil {
+		return nil, errors.New("invalid provider configuration")
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != provider.Issuer {
+		return nil, errors.New("provider issuer mismatch")
+	}
+
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+func (s *OIDCService) verifyIDToken(provider *OIDCProvider, discovery *oidcDiscovery, idToken string) (*oidcIDTokenClaims, error) {
+	claims := &oidcIDTokenClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.providerKey(provider, discovery, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(provider.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// providerKey returns the provider's signing key, refetching the JWKS once
+// when the kid is unknown (the provider rotated its keys)
+func (s *OIDCService) providerKey(provider *OIDCProvider, discovery *oidcDiscovery, kid string) (interface{}, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+
+	keys, err := s.fetchJWKS(discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	provider.keys = keys
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (s *OIDCService) fetchJWKS(jwksURI string) (map[string]interface{}, error) {
+	resp, err := s.httpClient.Get(jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&jwks) != nil {
+		return nil, errors.New("invalid provider JWKS")
+	}
+
+	decode := base64.RawURLEncoding.DecodeString
+	keys := make(map[string]interface{})
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decode(k.N)
+			e, err2 := decode(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, err1 := decode(k.X)
+			y, err2 := decode(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := decode(k.X)
+			if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[k.Kid] = ed25519.PublicKey(x)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxPinsPerRoom keeps the pinned list short enough to stay useful
+const maxPinsPerRoom = 50
+
+// PinMessage pins a message to its room. Only room admins may pin.
+func (s *ChatService) PinMessage(messageID, userID uint) (*models.PinnedMessage, error) {
+	var message models.Message
+	if err := config.DB.First(&message, messageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+	if !isRoomAdmin(message.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
+
+	var count int64
+	config.DB.Model(&models.PinnedMessage{}).Where("room_id = ?", message.RoomID).Count(&count)
+	if count >= maxPinsPerRoom {
+		return nil, errors.New("too many pinned messages")
+	}
+
+	pin := models.PinnedMessage{RoomID: message.RoomID, MessageID: message.ID, PinnedByID: userID}
+	result := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&pin)
+	if result.Error != nil {
+		return nil, errors.New("failed to pin message")
+	}
+	if result.RowsAffected == 0 {
+		config.DB.Where("message_id = ?", message.ID).First(&pin)
+		return &pin, nil
+	}
+
+	GetHub().BroadcastEvent(message.RoomID, map[string]interface{}{
+		"type":       "message_pinned",
+		"message_id": message.ID,
+		"room_id":    message.RoomID,
+		"pinned_by":  userID,
+		"timestamp":  pin.CreatedAt,
+	})
+	return &pin, nil
+}
+
+// UnpinMessage removes a pin. Only room admins may unpin.
+func (s *ChatService) UnpinMessage(messageID, userID uint) error {
+	var pin models.PinnedMessage
+	if err := config.DB.Where("message_id = ?", messageID).First(&pin).Error; err != nil {
+		return errors.New("message not pinned")
+	}
+	if !isRoomAdmin(pin.RoomID, userID) {
+		return errors.New("access denied")
+	}
+	if err := config.DB.Delete(&pin).Error; err != nil {
+		return errors.New("failed to unpin message")
+	}
+
+	broadcastUnpinned(pin.RoomID, messageID)
+	return nil
+}
+
+// GetPinnedMessages lists the pins of a room, most recently pinned first
+func (s *ChatService) GetPinnedMessages(roomID, userID uint) ([]models.PinnedMessage, error) {
+	if !isRoomMember(roomID, userID) {
+		return nil, errors.New("access denied")
+	}
+
+	pins := []models.PinnedMessage{}
+	if err := config.DB.
+		Preload("Message", func(db *gorm.DB) *gorm.DB { return db.Scopes(models.PreloadSender) }).
+		Where("room_id = ?", roomID).
+		Order("id DESC").
+		Find(&pins).Error; err != nil {
+		return nil, errors.New("failed to retrieve pinned messages")
+	}
+	return pins, nil
+}
+
+// StarMessage bookmarks a message for the user. Starring twice is a no-op.
+func (s *ChatService) StarMessage(messageID, userID uint) (*models.StarredMessage, error) {
+	var message models.Message
+	if err := config.DB.First(&message, messageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+	if !isRoomMember(message.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
+
+	star := models.StarredMessage{UserID: userID, MessageID: message.ID, RoomID: message.RoomID}
+	result := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&star)
+	if result.Error != nil {
+		return nil, errors.New("failed to star message")
+	}
+	if result.RowsAffected == 0 {
+		config.DB.Where("user_id = ? AND message_id = ?", userID, message.ID).First(&star)
+	}
+	return &star, nil
+}
+
+// UnstarMessage removes the user's bookmark
+func (s *ChatService) UnstarMessage(messageID, userID uint) error {
+	result := config.DB.Where("user_id = ? AND message_id = ?", userID, messageID).Delete(&models.StarredMessage{})
+	if result.Error != nil {
+		return errors.New("failed to unstar message")
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("message not starred")
+	}
+	return nil
+}
+
+// GetStarredMessages lists the user's bookmarks in rooms they still belong
+// to, most recently starred first, paged with before (a star ID)
+func (s *ChatService) GetStarredMessages(userID, before uint, limit int) ([]models.StarredMessage, bool, error) {
+	if limit <= 0 {
+		limit = defaultMessagePageSize
+	}
+	if limit > maxMessagePageSize {
+		limit = maxMessagePageSize
+	}
+
+	query := config.DB.
+		Preload("Message", func(db *gorm.DB) *gorm.DB { return db.Scopes(models.PreloadSender) }).
+		Joins("JOIN room_members ON room_members.room_id = starred_messages.room_id AND room_members.user_id = starred_messages.user_id").
+		Where("starred_messages.user_id = ?", userID)
+	if before != 0 {
+		query = query.Where("starred_messages.id < ?", before)
+	}
+
+	stars := []models.StarredMessage{}
+	if err := query.Order("starred_messages.id DESC").Limit(limit + 1).Find(&stars).Error; err != nil {
+		return nil, false, errors.New("failed to retrieve starred messages")
+	}
+	hasMore := len(stars) > limit
+	if hasMore {
+		stars = stars[:limit]
+	}
+	return stars, hasMore, nil
+}
+
+// ApplyPinsAndStars sets IsPinned and, for viewerID, IsStarred on messages
+func (s *ChatService) ApplyPinsAndStars(messages []models.Message, viewerID uint) {
+	if len(messages) == 0 {
+		return
+	}
+	ids := make([]uint, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+
+	var pinned, starred []uint
+	config.DB.Model(&models.PinnedMessage{}).Where("message_id IN ?", ids).Pluck("message_id", &pinned)
+	config.DB.Model(&models.StarredMessage{}).Where("user_id = ? AND message_id IN ?", viewerID, ids).Pluck("message_id", &starred)
+
+	pinnedSet := make(map[uint]bool, len(pinned))
+	for _, id := range pinned {
+		pinnedSet[id] = true
+	}
+	starredSet := make(map[uint]bool, len(starred))
+	for _, id := range starred {
+		starredSet[id] = true
+	}
+	for i := range messages {
+		messages[i].IsPinned = pinnedSet[messages[i].ID]
+		messages[i].IsStarred = starredSet[messages[i].ID]
+	}
+}
+
+// removePinsAndStars drops the pin and bookmarks of a deleted message and
+// reports whether it was pinned
+func removePinsAndStars(tx *gorm.DB, messageID uint) (bool, error) {
+	result := tx.Where("message_id = ?", messageID).Delete(&models.PinnedMessage{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if err := tx.Where("message_id = ?", messageID).Delete(&models.StarredMessage{}).Error; err != nil {
+		return false, err
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func broadcastUnpinned(roomID, messageID uint) {
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":       "message_unpinned",
+		"message_id": messageID,
+		"room_id":    roomID,
+		"timestamp":  time.Now(),
+	})
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// usernamePattern allows 3 to 30 letters, digits, dots and underscores, not
+// starting or ending with a dot so the name can be @mentioned at the end of
+// a sentence
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.]{1,28}[A-Za-z0-9_]$`)
+
+// ProfileUpdate holds the fields of a PATCH /me, nil fields are left unchanged
+type ProfileUpdate struct {
+	Name      *string
+	Username  *string
+	AvatarURL *string
+}
+
+type ProfileService struct {
+	sessionService *SessionService
+}
+
+func NewProfileService() *ProfileService {
+	return &ProfileService{
+		sessionService: NewSessionService(),
+	}
+}
+
+// GetProfile returns the user's own profile
+func (s *ProfileService) GetProfile(userID uint) (*models.User, error) {
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	return &user, nil
+}
+
+// UpdateProfile applies the update and tells the user's rooms about it
+func (s *ProfileService) UpdateProfile(userID uint, update ProfileUpdate) (*models.User, error) {
+	user, err := s.GetProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if name == "" {
+			return nil, errors.New("name cannot be empty")
+		}
+		updates["name"] = name
+	}
+	if update.Username != nil {
+		username := strings.TrimSpace(*update.Username)
+		if !usernamePattern.MatchString(username) {
+			return nil, errors.New("invalid username")
+		}
+		if usernameTaken(username, userID) {
+			return nil, errors.New("username already taken")
+		}
+		updates["username"] = username
+	}
+	if update.AvatarURL != nil {
+		avatarURL := strings.TrimSpace(*update.AvatarURL)
+		if avatarURL != "" && !isHTTPURL(avatarURL) {
+			return nil, errors.New("invalid avatar url")
+		}
+		updates["avatar_url"] = avatarURL
+	}
+
+	if len(updates) == 0 {
+		return user, nil
+	}
+	if err := config.DB.Model(user).Updates(updates).Error; err != nil {
+		return nil, errors.New("failed to update profile")
+	}
+
+	user, err = s.GetProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+	broadcastUserUpdated(user)
+	return user, nil
+}
+
+// ChangePassword replaces the password after checking the current one and
+// signs out every other session
+func (s *ProfileService) ChangePassword(userID, currentSessionID uint, currentPassword, newPassword string) error {
+	user, err := s.GetProfile(userID)
+	if err != nil {
+		return err
+	}
+	if !user.CheckPassword(currentPassword) {
+		return errors.New("invalid password")
+	}
+
+	user.Password = newPassword
+	if err := user.HashPassword(); err != nil {
+		return errors.New("failed to hash password")
+	}
+	if err := config.DB.Model(user).Update("password", user.Password).Error; err != nil {
+		return errors.New("failed to update password")
+	}
+
+	// A reset link sent before the change must not be able to undo it
+	invalidateActionTokens(user.ID, purposePasswordReset)
+
+	return s.sessionService.RevokeUserSessions(user.ID, currentSessionID)
+}
+
+// broadcastUserUpdated sends the new public profile to every room of the user
+func broadcastUserUpdated(user *models.User) {
+	var roomIDs []uint
+	if err := config.DB.Model(&models.RoomMember{}).Where("user_id = ?", user.ID).Pluck("room_id", &roomIDs).Error; err != nil {
+		return
+	}
+
+	event := map[string]interface{}{
+		"type": "user_updated",
+		"user": map[string]interface{}{
+			"id":         user.ID,
+			"name":       user.Name,
+			"username":   user.Username,
+			"avatar_url": user.AvatarURL,
+		},
+		"timestamp": time.Now(),
+	}
+	hub := GetHub()
+	for _, roomID := range roomIDs {
+		hub.BroadcastEvent(roomID, event)
+	}
+}
+
+// usernameTaken checks case-insensitively, including soft-deleted users
+// since they still hold the unique index entry. Mention keywords are
+// always taken.
+func usernameTaken(username string, exceptUserID uint) bool {
+	if reservedUsernames[strings.ToLower(username)] {
+		return true
+	}
+	var count int64
+	config.DB.Unscoped().Model(&models.User{}).
+		Where("username = ? COLLATE NOCASE AND id <> ?", username, exceptUserID).
+		Count(&count)
+	return count > 0
+}
+
+// GenerateUsername derives a free username from an email address
+func GenerateUsername(email string) string {
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '.':
+			return r
+		default:
+			return -1
+		}
+	}, strings.ToLower(strings.Split(email, "@")[0]))
+	if len(base) > 20 {
+		base = base[:20]
+	}
+	base = strings.Trim(base, ".")
+	if len(base) < 3 {
+		base = "user" + base
+	}
+
+	username := base
+	for i := 0; usernameTaken(username, 0); i++ {
+		if i >= 5 {
+			// Unlucky: widen the suffix so this terminates
+			username = fmt.Sprintf("%s%d", base, rand.Int63())
+			continue
+		}
+		username = fmt.Sprintf("%s%d", base, rand.Intn(10000))
+	}
+	return username
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
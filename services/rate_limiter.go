@@ -0,0 +1,69 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is an in-memory token bucket per key: each key may burst up to
+// limit actions and regains one every interval/limit
+type RateLimiter struct {
+	mu        sync.Mutex
+	limit     float64
+	refill    float64 // tokens per second
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(limit int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:   float64(limit),
+		refill:  float64(limit) / interval.Seconds(),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for key and reports whether one was available
+func (r *RateLimiter) Allow(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweepLocked(now)
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: r.limit, last: now}
+		r.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * r.refill
+	if bucket.tokens > r.limit {
+		bucket.tokens = r.limit
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweepLocked forgets buckets that are full again, at most once a minute
+func (r *RateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for key, bucket := range r.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*r.refill >= r.limit {
+			delete(r.buckets, key)
+		}
+	}
+}
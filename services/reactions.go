@@ -0,0 +1,168 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gorm.io/gorm/clause"
+)
+
+const maxEmojiLength = 32
+
+// reactionLimiter allows each user a burst of 20 reactions, refilled over 30 seconds
+var reactionLimiter = NewRateLimiter(20, 30*time.Second)
+
+// AddReaction reacts to a message with emoji. Reacting twice with the same
+// emoji is a no-op.
+func (s *ChatService) AddReaction(messageID, userID uint, emoji string) (*models.Reaction, error) {
+	emoji, err := normalizeEmoji(emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.reactableMessage(messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	reaction := models.Reaction{MessageID: message.ID, UserID: userID, Emoji: emoji}
+	result := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+	if result.Error != nil {
+		return nil, errors.New("failed to add reaction")
+	}
+	if result.RowsAffected == 0 {
+		config.DB.Where("message_id = ? AND user_id = ? AND emoji = ?", message.ID, userID, emoji).First(&reaction)
+		return &reaction, nil
+	}
+
+	broadcastReaction("reaction_added", message, userID, emoji)
+	return &reaction, nil
+}
+
+// RemoveReaction takes back the user's emoji on a message
+func (s *ChatService) RemoveReaction(messageID, userID uint, emoji string) error {
+	emoji, err := normalizeEmoji(emoji)
+	if err != nil {
+		return err
+	}
+
+	message, err := s.reactableMessage(messageID, userID)
+	if err != nil {
+		return err
+	}
+
+	result := config.DB.
+		Where("message_id = ? AND user_id = ? AND emoji = ?", message.ID, userID, emoji).
+		Delete(&models.Reaction{})
+	if result.Error != nil {
+		return errors.New("failed to remove reaction")
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("reaction not found")
+	}
+
+	broadcastReaction("reaction_removed", message, userID, emoji)
+	return nil
+}
+
+// reactableMessage loads a live message the user may react to, charging the
+// user's reaction rate limit
+func (s *ChatService) reactableMessage(messageID, userID uint) (*models.Message, error) {
+	var message models.Message
+	if err := config.DB.First(&message, messageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+	if !isRoomMember(message.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
+	if !reactionLimiter.Allow(strconv.FormatUint(uint64(userID), 10)) {
+		return nil, errors.New("too many reactions")
+	}
+	return &message, nil
+}
+
+// ApplyReactions fills the aggregated reactions of messages, with Reacted
+// set for the emoji viewerID used. Tombstones keep no reactions.
+func (s *ChatService) ApplyReactions(messages []models.Message, viewerID uint) {
+	ids := make([]uint, 0, len(messages))
+	for _, message := range messages {
+		if !message.IsDeleted {
+			ids = append(ids, message.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	var rows []struct {
+		MessageID uint
+		Emoji     string
+		Count     int
+		Reacted   bool
+	}
+	if err := config.DB.Model(&models.Reaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, MAX(user_id = ?) AS reacted, MIN(id) AS first_id", viewerID).
+		Where("message_id IN ?", ids).
+		Group("message_id, emoji").
+		Order("first_id ASC").
+		Scan(&rows).Error; err != nil {
+		return
+	}
+
+	byMessage := make(map[uint][]models.ReactionCount)
+	for _, row := range rows {
+		byMessage[row.MessageID] = append(byMessage[row.MessageID], models.ReactionCount{
+			Emoji:   row.Emoji,
+			Count:   row.Count,
+			Reacted: row.Reacted,
+		})
+	}
+	for i := range messages {
+		if reactions, ok := byMessage[messages[i].ID]; ok {
+			messages[i].Reactions = reactions
+		} else {
+			messages[i].Reactions = []models.ReactionCount{}
+		}
+	}
+}
+
+// normalizeEmoji accepts a short emoji or :shortcode: without whitespace
+func normalizeEmoji(emoji string) (string, error) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" {
+		return "", errors.New("emoji is required")
+	}
+	if len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return "", errors.New("invalid emoji")
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "", errors.New("invalid emoji")
+		}
+	}
+	return emoji, nil
+}
+
+// broadcastReaction pushes a reaction change along with the new count of the emoji
+func broadcastReaction(eventType string, message *models.Message, userID uint, emoji string) {
+	var count int64
+	config.DB.Model(&models.Reaction{}).
+		Where("message_id = ? AND emoji = ?", message.ID, emoji).
+		Count(&count)
+
+	GetHub().BroadcastEvent(message.RoomID, map[string]interface{}{
+		"type":       eventType,
+		"message_id": message.ID,
+		"parent_id":  message.ParentID,
+		"user_id":    userID,
+		"emoji":      emoji,
+		"count":      count,
+		"timestamp":  time.Now(),
+	})
+}
@@ -0,0 +1,382 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RoomMemberInfo is a member as listed by GetRoomMembers
+type RoomMemberInfo struct {
+	User     models.User `json:"user"`
+	Role     string      `json:"role"`
+	JoinedAt time.Time   `json:"joined_at"`
+}
+
+// GetRoomMembers lists the members of a room with their role, owner first
+func (s *ChatService) GetRoomMembers(roomID, userID uint) ([]RoomMemberInfo, error) {
+	if !isRoomMember(roomID, userID) {
+		return nil, errors.New("access denied")
+	}
+
+	var members []models.RoomMember
+	if err := config.DB.
+		Where("room_id = ?", roomID).
+		Order("CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, joined_at").
+		Find(&members).Error; err != nil {
+		return nil, errors.New("failed to retrieve members")
+	}
+
+	userIDs := make([]uint, len(members))
+	for i, member := range members {
+		userIDs[i] = member.UserID
+	}
+	var users []models.User
+	if err := config.DB.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return nil, errors.New("failed to retrieve members")
+	}
+	byID := make(map[uint]models.User, len(users))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+
+	infos := make([]RoomMemberInfo, 0, len(members))
+	for _, member := range members {
+		if user, ok := byID[member.UserID]; ok {
+			infos = append(infos, RoomMemberInfo{User: user, Role: member.Role, JoinedAt: member.JoinedAt})
+		}
+	}
+	return infos, nil
+}
+
+// AddMemberToRoom adds a user to a group room. Unless the room lets any
+// member add people, only room admins may add members.
+func (s *ChatService) AddMemberToRoom(roomID, userID, newMemberID uint) error {
+	room, err := groupRoom(roomID)
+	if err != nil {
+		return err
+	}
+	actor, err := roomMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if !canAddMembers(room, actor) {
+		return errors.New("access denied")
+	}
+
+	var newMember models.User
+	if err := config.DB.First(&newMember, newMemberID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if isRoomMember(roomID, newMemberID) {
+		return errors.New("user is already a member")
+	}
+
+	if err := config.DB.Create(&models.RoomMember{RoomID: roomID, UserID: newMemberID, Role: models.RoomRoleMember}).Error; err != nil {
+		return errors.New("failed to add member")
+	}
+
+	postSystemMessage(roomID, userID, fmt.Sprintf("%s added %s", displayName(userID), displayName(newMemberID)))
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":      "member_added",
+		"room_id":   roomID,
+		"user_id":   newMemberID,
+		"added_by":  userID,
+		"timestamp": time.Now(),
+	})
+	return nil
+}
+
+// RemoveMember removes someone else from a group room. Admins remove
+// members, only the owner removes admins, nobody removes the owner.
+func (s *ChatService) RemoveMember(roomID, userID, memberID uint) error {
+	if _, err := groupRoom(roomID); err != nil {
+		return err
+	}
+	if userID == memberID {
+		return errors.New("use leave to remove yourself")
+	}
+	actor, err := roomMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	target, err := roomMember(roomID, memberID)
+	if err != nil {
+		return errors.New("user is not a member")
+	}
+	if !actor.IsAdmin() || target.Role == models.RoomRoleOwner ||
+		(target.Role == models.RoomRoleAdmin && actor.Role != models.RoomRoleOwner) {
+		return errors.New("access denied")
+	}
+
+	if err := deleteRoomMember(roomID, memberID); err != nil {
+		return errors.New("failed to remove member")
+	}
+
+	postSystemMessage(roomID, userID, fmt.Sprintf("%s removed %s", displayName(userID), displayName(memberID)))
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":       "member_removed",
+		"room_id":    roomID,
+		"user_id":    memberID,
+		"removed_by": userID,
+		"timestamp":  time.Now(),
+	})
+	disconnectFromRoom(roomID, memberID)
+	return nil
+}
+
+// LeaveRoom removes the user from a group room. The owner has to transfer
+// ownership first, unless nobody else is left, in which case the room goes too.
+func (s *ChatService) LeaveRoom(roomID, userID uint) error {
+	room, err := groupRoom(roomID)
+	if err != nil {
+		return err
+	}
+	member, err := roomMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+
+	var others int64
+	config.DB.Model(&models.RoomMember{}).Where("room_id = ? AND user_id <> ?", roomID, userID).Count(&others)
+	if member.Role == models.RoomRoleOwner && others > 0 {
+		return errors.New("owner must transfer ownership before leaving")
+	}
+
+	if err := deleteRoomMember(roomID, userID); err != nil {
+		return errors.New("failed to leave room")
+	}
+	disconnectFromRoom(roomID, userID)
+
+	if others == 0 {
+		config.DB.Delete(room)
+		return nil
+	}
+
+	postSystemMessage(roomID, userID, fmt.Sprintf("%s left", displayName(userID)))
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":      "member_left",
+		"room_id":   roomID,
+		"user_id":   userID,
+		"timestamp": time.Now(),
+	})
+	return nil
+}
+
+// handOverOwnedRooms finds a new owner for every group the user owns before
+// their memberships go away: the oldest admin, else the oldest member. Rooms
+// with nobody else left are deleted. It returns the new owner of each room.
+func handOverOwnedRooms(tx *gorm.DB, userID uint) (map[uint]uint, error) {
+	var roomIDs []uint
+	if err := tx.Model(&models.RoomMember{}).
+		Joins("JOIN chat_rooms ON chat_rooms.id = room_members.room_id AND chat_rooms.deleted_at IS NULL").
+		Where("room_members.user_id = ? AND room_members.role = ? AND chat_rooms.is_group = ?", userID, models.RoomRoleOwner, true).
+		Pluck("room_members.room_id", &roomIDs).Error; err != nil {
+		return nil, err
+	}
+
+	newOwners := make(map[uint]uint)
+	for _, roomID := range roomIDs {
+		var successor models.RoomMember
+		err := tx.Where("room_id = ? AND user_id <> ?", roomID, userID).
+			Order("CASE role WHEN 'admin' THEN 0 ELSE 1 END, joined_at, user_id").
+			First(&successor).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := tx.Delete(&models.ChatRoom{}, roomID).Error; err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tx.Model(&models.RoomMember{}).
+			Where("room_id = ? AND user_id = ?", roomID, successor.UserID).
+			Update("role", models.RoomRoleOwner).Error; err != nil {
+			return nil, err
+		}
+		newOwners[roomID] = successor.UserID
+	}
+	return newOwners, nil
+}
+
+// SetMemberRole promotes a member to admin or demotes an admin. Only the owner may.
+func (s *ChatService) SetMemberRole(roomID, userID, memberID uint, role string) error {
+	if role != models.RoomRoleAdmin && role != models.RoomRoleMember {
+		return errors.New("invalid role")
+	}
+	if _, err := groupRoom(roomID); err != nil {
+		return err
+	}
+	actor, err := roomMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if actor.Role != models.RoomRoleOwner || userID == memberID {
+		return errors.New("access denied")
+	}
+	target, err := roomMember(roomID, memberID)
+	if err != nil {
+		return errors.New("user is not a member")
+	}
+	if target.Role == role {
+		return nil
+	}
+
+	if err := config.DB.Model(&models.RoomMember{}).
+		Where("room_id = ? AND user_id = ?", roomID, memberID).
+		Update("role", role).Error; err != nil {
+		return errors.New("failed to change role")
+	}
+
+	content := fmt.Sprintf("%s made %s an admin", displayName(userID), displayName(memberID))
+	if role == models.RoomRoleMember {
+		content = fmt.Sprintf("%s removed %s as admin", displayName(userID), displayName(memberID))
+	}
+	postSystemMessage(roomID, userID, content)
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":       "member_role_changed",
+		"room_id":    roomID,
+		"user_id":    memberID,
+		"role":       role,
+		"changed_by": userID,
+		"timestamp":  time.Now(),
+	})
+	return nil
+}
+
+// TransferOwnership hands the room over to another member. The previous
+// owner stays on as an admin.
+func (s *ChatService) TransferOwnership(roomID, userID, newOwnerID uint) error {
+	if _, err := groupRoom(roomID); err != nil {
+		return err
+	}
+	actor, err := roomMember(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if actor.Role != models.RoomRoleOwner || userID == newOwnerID {
+		return errors.New("access denied")
+	}
+	if _, err := roomMember(roomID, newOwnerID); err != nil {
+		return errors.New("user is not a member")
+	}
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.RoomMember{}).
+			Where("room_id = ? AND user_id = ?", roomID, userID).
+			Update("role", models.RoomRoleAdmin).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.RoomMember{}).
+			Where("room_id = ? AND user_id = ?", roomID, newOwnerID).
+			Update("role", models.RoomRoleOwner).Error
+	})
+	if err != nil {
+		return errors.New("failed to transfer ownership")
+	}
+
+	postSystemMessage(roomID, userID, fmt.Sprintf("%s made %s the owner", displayName(userID), displayName(newOwnerID)))
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":           "ownership_transferred",
+		"room_id":        roomID,
+		"user_id":        newOwnerID,
+		"previous_owner": userID,
+		"timestamp":      time.Now(),
+	})
+	return nil
+}
+
+// groupRoom loads a room whose membership can be managed
+func groupRoom(roomID uint) (*models.ChatRoom, error) {
+	var room models.ChatRoom
+	if err := config.DB.First(&room, roomID).Error; err != nil {
+		return nil, errors.New("room not found")
+	}
+	if !room.IsGroup {
+		return nil, errors.New("cannot manage members of a direct chat")
+	}
+	return &room, nil
+}
+
+// roomMember loads the membership of the user, access denied if there is none
+func roomMember(roomID, userID uint) (*models.RoomMember, error) {
+	var member models.RoomMember
+	if err := config.DB.Where("room_id = ? AND user_id = ?", roomID, userID).First(&member).Error; err != nil {
+		return nil, errors.New("access denied")
+	}
+	return &member, nil
+}
+
+// canAddMembers applies the room's add member policy
+func canAddMembers(room *models.ChatRoom, member *models.RoomMember) bool {
+	return member.IsAdmin() || room.Settings.AddMemberPolicy == models.RoomPolicyMembers
+}
+
+// isRoomAdmin reports whether the user manages the room: an owner or admin
+// of a group, or either member of a direct chat
+func isRoomAdmin(roomID, userID uint) bool {
+	var room models.ChatRoom
+	if err := config.DB.First(&room, roomID).Error; err != nil {
+		return false
+	}
+	member, err := roomMember(roomID, userID)
+	if err != nil {
+		return false
+	}
+	return !room.IsGroup || member.IsAdmin()
+}
+
+func deleteRoomMember(roomID, userID uint) error {
+	return config.DB.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&models.RoomMember{}).Error
+}
+
+// disconnectFromRoom tells the user's sockets on the room they are no longer
+// a member and closes them
+func disconnectFromRoom(roomID, userID uint) {
+	GetHub().DisconnectRoomMember(roomID, userID, map[string]interface{}{
+		"type":      "removed_from_room",
+		"room_id":   roomID,
+		"timestamp": time.Now(),
+	})
+}
+
+// postSystemMessage records a room event in the history, in the name of
+// the member who acted, and pushes it like any other message
+func postSystemMessage(roomID, actorID uint, content string) {
+	message := models.Message{
+		Type:     models.MessageTypeSystem,
+		RoomID:   roomID,
+		SenderID: actorID,
+		Content:  content,
+	}
+	if err := config.DB.Create(&message).Error; err != nil {
+		log.Printf("Failed to record system message in room %d: %v", roomID, err)
+		return
+	}
+	config.DB.Model(&models.ChatRoom{}).Where("id = ?", roomID).Update("updated_at", message.CreatedAt)
+	config.DB.Scopes(models.PreloadSender).First(&message, message.ID)
+
+	GetHub().BroadcastEvent(roomID, map[string]interface{}{
+		"type":    "message",
+		"message": message,
+	})
+}
+
+// displayName is how system messages refer to a user
+func displayName(userID uint) string {
+	var user models.User
+	if err := config.DB.Unscoped().First(&user, userID).Error; err != nil {
+		return "Someone"
+	}
+	if user.Name != "" {
+		return user.Name
+	}
+	return user.Username
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+)
+
+// RoomSummary is a room as shown in the room list: the room itself with its
+// last message and the user's unread and mention counts
+type RoomSummary struct {
+	models.ChatRoom
+	LastMessage  *models.Message `json:"last_message"`
+	UnreadCount  int64           `json:"unread_count"`
+	MentionCount int64           `json:"mention_count"`
+}
+
+// UnreadTotals is the badge shown next to the room list
+type UnreadTotals struct {
+	TotalUnread     int64 `json:"total_unread"`
+	TotalMentions   int64 `json:"total_mentions"`
+	RoomsWithUnread int64 `json:"rooms_with_unread"`
+}
+
+// roomUnread is one row of unreadCounts
+type roomUnread struct {
+	RoomID       uint
+	UnreadCount  int64
+	MentionCount int64
+}
+
+// GetRoomSummaries lists the user's rooms with their summaries in a fixed
+// number of queries, whatever the number of rooms
+func (s *ChatService) GetRoomSummaries(userID uint) ([]RoomSummary, error) {
+	var rooms []models.ChatRoom
+	if err := config.DB.
+		Joins("JOIN room_members ON room_members.room_id = chat_rooms.id").
+		Where("room_members.user_id = ?", userID).
+		Preload("Members").
+		Preload("Creator").
+		Order("chat_rooms.updated_at DESC").
+		Find(&rooms).Error; err != nil {
+		return nil, errors.New("failed to retrieve rooms")
+	}
+	if len(rooms) == 0 {
+		return []RoomSummary{}, nil
+	}
+
+	roomIDs := make([]uint, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = room.ID
+	}
+
+	// Last message of every room at once, from the timeline: thread replies
+	// only show in their thread
+	var lastMessages []models.Message
+	if err := config.DB.
+		Scopes(models.PreloadSender).
+		Where("id IN (?)", config.DB.Model(&models.Message{}).
+			Select("MAX(id)").
+			Where("room_id IN ? AND parent_id IS NULL", roomIDs).
+			Group("room_id")).
+		Find(&lastMessages).Error; err != nil {
+		return nil, errors.New("failed to retrieve rooms")
+	}
+	lastByRoom := make(map[uint]*models.Message, len(lastMessages))
+	for i := range lastMessages {
+		lastByRoom[lastMessages[i].RoomID] = &lastMessages[i]
+	}
+
+	unread, err := unreadCounts(userID)
+	if err != nil {
+		return nil, errors.New("failed to retrieve rooms")
+	}
+
+	summaries := make([]RoomSummary, len(rooms))
+	for i, room := range rooms {
+		summaries[i] = RoomSummary{ChatRoom: room}
+		if last, ok := lastByRoom[room.ID]; ok {
+			summaries[i].LastMessage = last
+			// Kept for clients reading the last message from messages[0]
+			summaries[i].Messages = []models.Message{*last}
+		}
+		if counts, ok := unread[room.ID]; ok {
+			summaries[i].UnreadCount = counts.UnreadCount
+			summaries[i].MentionCount = counts.MentionCount
+		}
+	}
+	return summaries, nil
+}
+
+// GetUnreadTotals sums the unread and mention counts over all of the user's rooms
+func (s *ChatService) GetUnreadTotals(userID uint) (*UnreadTotals, error) {
+	unread, err := unreadCounts(userID)
+	if err != nil {
+		return nil, errors.New("failed to count unread messages")
+	}
+
+	totals := &UnreadTotals{}
+	for _, counts := range unread {
+		totals.TotalUnread += counts.UnreadCount
+		totals.TotalMentions += counts.MentionCount
+		if counts.UnreadCount > 0 {
+			totals.RoomsWithUnread++
+		}
+	}
+	return totals, nil
+}
+
+// unreadCounts counts, per room, the messages of others after the user's read
+// cursor and those of them mentioning the user
+func unreadCounts(userID uint) (map[uint]roomUnread, error) {
+	var rows []roomUnread
+	if err := config.DB.
+		Table("messages").
+		Select("messages.room_id AS room_id, COUNT(*) AS unread_count, COUNT(mentions.id) AS mention_count").
+		Joins("JOIN room_members ON room_members.room_id = messages.room_id AND room_members.user_id = ?", userID).
+		Joins("LEFT JOIN mentions ON mentions.message_id = messages.id AND mentions.user_id = ?", userID).
+		Where("messages.id > room_members.last_read_message_id AND messages.sender_id <> ? AND messages.deleted_at IS NULL", userID).
+		Where("messages.type <> ?", models.MessageTypeSystem).
+		Group("messages.room_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint]roomUnread, len(rows))
+	for _, row := range rows {
+		counts[row.RoomID] = row
+	}
+	return counts, nil
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"errors"
+	"html"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+	maxSearchTerms        = 10
+
+	// Snippets keep this many runes of context around the first match
+	snippetContext = 60
+
+	// Sentinels around matches in raw snippets, replaced by <mark> once escaped
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+// SearchQuery selects messages of the caller's rooms matching Text. RoomID,
+// SenderID, From and To narrow the search; Before is the cursor of the
+// previous page.
+type SearchQuery struct {
+	Text     string
+	RoomID   uint
+	SenderID uint
+	From     *time.Time
+	To       *time.Time
+	Before   uint
+	Limit    int
+}
+
+// SearchResult is a matching message with an HTML snippet where matches
+// are wrapped in <mark>
+type SearchResult struct {
+	models.Message
+	RoomName string `json:"room_name"`
+	Snippet  string `json:"snippet"`
+}
+
+// SearchPage is a page of results, newest first
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor *uint          `json:"next_cursor"`
+	HasMore    bool           `json:"has_more"`
+}
+
+// SearchMessages searches the content of live messages in the rooms the user
+// belongs to, on the FTS5 index when SQLite has it
+func (s *ChatService) SearchMessages(userID uint, q SearchQuery) (*SearchPage, error) {
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 {
+		return nil, errors.New("search query is required")
+	}
+	if q.RoomID != 0 && !isRoomMember(q.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultSearchPageSize
+	}
+	if q.Limit > maxSearchPageSize {
+		q.Limit = maxSearchPageSize
+	}
+
+	query := config.DB.Table("messages").
+		Where("messages.deleted_at IS NULL AND messages.type <> ?", models.MessageTypeSystem).
+		Where("messages.room_id IN (SELECT room_id FROM room_members WHERE user_id = ?)", userID)
+
+	if config.MessageSearchFTS {
+		query = query.
+			Select("messages.id, snippet(messages_fts, 0, ?, ?, '…', 16) AS snippet", markStart, markEnd).
+			Joins("JOIN messages_fts ON messages_fts.rowid = messages.id").
+			Where("messages_fts MATCH ?", ftsQuery(terms))
+	} else {
+		query = query.Select("messages.id, '' AS snippet")
+		for _, term := range terms {
+			query = query.Where("messages.content LIKE ? ESCAPE '\\'", "%"+escapeLike(term)+"%")
+		}
+	}
+
+	if q.RoomID != 0 {
+		query = query.Where("messages.room_id = ?", q.RoomID)
+	}
+	if q.SenderID != 0 {
+		query = query.Where("messages.sender_id = ?", q.SenderID)
+	}
+	if q.From != nil {
+		query = query.Where("messages.created_at >= ?", *q.From)
+	}
+	if q.To != nil {
+		query = query.Where("messages.created_at < ?", *q.To)
+	}
+	if q.Before != 0 {
+		query = query.Where("messages.id < ?", q.Before)
+	}
+
+	var hits []struct {
+		ID      uint
+		Snippet string
+	}
+	if err := query.Order("messages.id DESC").Limit(q.Limit + 1).Scan(&hits).Error; err != nil {
+		return nil, errors.New("failed to search messages")
+	}
+
+	page := &SearchPage{Results: []SearchResult{}}
+	if len(hits) > q.Limit {
+		hits, page.HasMore = hits[:q.Limit], true
+	}
+	if len(hits) == 0 {
+		return page, nil
+	}
+
+	ids := make([]uint, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+	var messages []models.Message
+	if err := config.DB.Scopes(models.PreloadSender).Where("id IN ?", ids).Order("id DESC").Find(&messages).Error; err != nil {
+		return nil, errors.New("failed to search messages")
+	}
+
+	roomIDs := make([]uint, len(messages))
+	for i, message := range messages {
+		roomIDs[i] = message.RoomID
+	}
+	var rooms []models.ChatRoom
+	config.DB.Select("id, name").Where("id IN ?", roomIDs).Find(&rooms)
+	roomNames := make(map[uint]string, len(rooms))
+	for _, room := range rooms {
+		roomNames[room.ID] = room.Name
+	}
+
+	snippets := make(map[uint]string, len(hits))
+	for _, hit := range hits {
+		snippets[hit.ID] = hit.Snippet
+	}
+	for _, message := range messages {
+		snippet := snippets[message.ID]
+		if !config.MessageSearchFTS {
+			snippet = makeSnippet(message.Content, terms)
+		}
+		page.Results = append(page.Results, SearchResult{
+			Message:  message,
+			RoomName: roomNames[message.RoomID],
+			Snippet:  highlightSnippet(snippet),
+		})
+	}
+
+	if page.HasMore {
+		page.NextCursor = &page.Results[len(page.Results)-1].ID
+	}
+	return page, nil
+}
+
+// searchTerms splits the query into lowercase words
+func searchTerms(text string) []string {
+	terms := strings.Fields(strings.ToLower(text))
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return terms
+}
+
+// ftsQuery matches messages containing every term, each as a word prefix.
+// Terms are quoted so FTS5 operators in user input are taken literally.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// escapeLike escapes the LIKE wildcards of s, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// makeSnippet cuts the content around the first term found and marks every
+// occurrence of the terms, like FTS5's snippet() does for the LIKE fallback
+func makeSnippet(content string, terms []string) string {
+	runes := []rune(content)
+	lower := []rune(strings.ToLower(content))
+	if len(lower) != len(runes) {
+		// Case folding changed the length, match on the original runes
+		lower = runes
+	}
+
+	matchAt := func(i int) int {
+		for _, term := range terms {
+			t := []rune(term)
+			if i+len(t) <= len(lower) && string(lower[i:i+len(t)]) == term {
+				return len(t)
+			}
+		}
+		return 0
+	}
+
+	first := 0
+	for i := range lower {
+		if matchAt(i) > 0 {
+			first = i
+			break
+		}
+	}
+
+	start, end := max(0, first-snippetContext), min(len(runes), first+2*snippetContext)
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		if n := matchAt(i); n > 0 {
+			n = min(n, end-i)
+			b.WriteString(markStart + string(runes[i:i+n]) + markEnd)
+			i += n
+			continue
+		}
+		b.WriteRune(runes[i])
+		i++
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// highlightSnippet escapes a raw snippet and turns its sentinels into <mark> tags
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>").Replace(escaped)
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"time"
+)
+
+// TokenPair is returned to clients after login, registration or refresh
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// DeviceInfo describes the client a session is created from
+type DeviceInfo struct {
+	Name      string
+	UserAgent string
+	IP        string
+}
+
+// How often LastUsedAt is written back while a session is in use
+const sessionTouchInterval = time.Minute
+
+type SessionService struct{}
+
+func NewSessionService() *SessionService {
+	return &SessionService{}
+}
+
+// CreateSession starts a new session for the user and issues its first token pair
+func (s *SessionService) CreateSession(user *models.User, device DeviceInfo) (*TokenPair, error) {
+	if user.IsBanned() {
+		return nil, errors.New("account is banned")
+	}
+
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+
+	deviceName := device.Name
+	if deviceName == "" {
+		deviceName = "Unknown device"
+	}
+
+	session := models.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: utils.HashToken(refreshToken),
+		DeviceName:       deviceName,
+		UserAgent:        device.UserAgent,
+		IPAddress:        device.IP,
+		LastUsedAt:       time.Now(),
+		ExpiresAt:        time.Now().Add(utils.RefreshTokenTTL),
+	}
+	if err := config.DB.Create(&session).Error; err != nil {
+		return nil, errors.New("failed to create session")
+	}
+
+	return s.issue(user, &session, refreshToken)
+}
+
+// Refresh rotates a refresh token and returns a new token pair.
+// Presenting an already rotated refresh token revokes the whole session.
+func (s *SessionService) Refresh(refreshToken string) (*TokenPair, error) {
+	hash := utils.HashToken(refreshToken)
+
+	var session models.Session
+	if err := config.DB.Where("refresh_token_hash = ?", hash).First(&session).Error; err != nil {
+		// Token reuse: someone is replaying a refresh token that was already rotated
+		if err := config.DB.Where("previous_token_hash = ?", hash).First(&session).Error; err == nil {
+			s.RevokeSession(session.ID)
+		}
+		return nil, errors.New("invalid refresh token")
+	}
+
+	if !session.IsActive() {
+		return nil, errors.New("session expired or revoked")
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, session.UserID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.IsBanned() {
+		return nil, errors.New("account is banned")
+	}
+
+	newToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+
+	// Conditional update so two concurrent refreshes cannot both succeed
+	result := config.DB.Model(&models.Session{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":  utils.HashToken(newToken),
+			"previous_token_hash": hash,
+			"last_used_at":        time.Now(),
+			"expires_at":          time.Now().Add(utils.RefreshTokenTTL),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, errors.New("invalid refresh token")
+	}
+
+	return s.issue(&user, &session, newToken)
+}
+
+// UseSession reports whether the session behind an access token is still active
+// and records that it was used
+func (s *SessionService) UseSession(sessionID, userID uint) bool {
+	var session models.Session
+	if err := config.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		return false
+	}
+	if !session.IsActive() {
+		return false
+	}
+
+	// Avoid a write on every request
+	if time.Since(session.LastUsedAt) > sessionTouchInterval {
+		config.DB.Model(&session).Update("last_used_at", time.Now())
+	}
+	return true
+}
+
+// GetUserSessions lists the active sessions (logged-in devices) of a user
+func (s *SessionService) GetUserSessions(userID, currentSessionID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	if err := config.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error; err != nil {
+		return nil, errors.New("failed to retrieve sessions")
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+	return sessions, nil
+}
+
+// RevokeUserSession signs out one of the user's own devices
+func (s *SessionService) RevokeUserSession(userID, sessionID uint) error {
+	var session models.Session
+	if err := config.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		return errors.New("session not found")
+	}
+	return s.RevokeSession(session.ID)
+}
+
+// RevokeSession revokes a single session and closes its WebSocket connections
+func (s *SessionService) RevokeSession(sessionID uint) error {
+	if err := config.DB.Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return errors.New("failed to revoke session")
+	}
+
+	GetHub().DisconnectSession(sessionID)
+	return nil
+}
+
+// RevokeUserSessions revokes every session of a user except exceptSessionID (0 revokes all)
+func (s *SessionService) RevokeUserSessions(userID, exceptSessionID uint) error {
+	var sessionIDs []uint
+	if err := config.DB.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, exceptSessionID).
+		Pluck("id", &sessionIDs).Error; err != nil {
+		return errors.New("failed to revoke sessions")
+	}
+
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	if err := config.DB.Model(&models.Session{}).
+		Where("id IN ?", sessionIDs).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return errors.New("failed to revoke sessions")
+	}
+
+	hub := GetHub()
+	for _, sessionID := range sessionIDs {
+		hub.DisconnectSession(sessionID)
+	}
+	return nil
+}
+
+func (s *SessionService) issue(user *models.User, session *models.Session, refreshToken string) (*TokenPair, error) {
+	accessToken, err := utils.GenerateToken(user.ID, user.Email, session.ID)
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(utils.AccessTokenTTL.Seconds()),
+	}, nil
+}
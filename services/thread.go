@@ -0,0 +1,121 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"time"
+)
+
+// Thread is a message with its replies, oldest first
+type Thread struct {
+	Parent       models.Message   `json:"parent"`
+	Replies      []models.Message `json:"replies"`
+	Participants []models.User    `json:"participants"`
+	HasMore      bool             `json:"has_more"`
+}
+
+// GetThread returns the thread started by messageID. Replies are paged
+// forward with after (a reply ID) and limit.
+func (s *ChatService) GetThread(messageID, userID, after uint, limit int) (*Thread, error) {
+	var parent models.Message
+	// A deleted parent stays visible as a tombstone above its replies
+	if err := config.DB.Unscoped().Scopes(models.PreloadSender).First(&parent, messageID).Error; err != nil {
+		return nil, errors.New("message not found")
+	}
+	if !isRoomMember(parent.RoomID, userID) {
+		return nil, errors.New("access denied")
+	}
+	if parent.ParentID != nil {
+		return nil, errors.New("message is a reply")
+	}
+
+	if limit <= 0 {
+		limit = defaultMessagePageSize
+	}
+	if limit > maxMessagePageSize {
+		limit = maxMessagePageSize
+	}
+
+	thread := &Thread{Parent: parent}
+	if err := config.DB.Unscoped().
+		Scopes(models.PreloadSender).
+		Where("parent_id = ? AND id > ?", parent.ID, after).
+		Order("id ASC").
+		Limit(limit + 1).
+		Find(&thread.Replies).Error; err != nil {
+		return nil, errors.New("failed to retrieve thread")
+	}
+	thread.Replies, thread.HasMore = trimPage(thread.Replies, limit)
+
+	var err error
+	if thread.Participants, err = threadParticipants(parent.ID); err != nil {
+		return nil, errors.New("failed to retrieve thread")
+	}
+
+	var room models.ChatRoom
+	if err := config.DB.First(&room, parent.RoomID).Error; err == nil {
+		s.ApplyReadState(&room, thread.Replies)
+	}
+	parents := []models.Message{thread.Parent}
+	s.applyMessageDetails(parents, userID)
+	thread.Parent = parents[0]
+	s.applyMessageDetails(thread.Replies, userID)
+	return thread, nil
+}
+
+// threadRoot returns the message a reply to messageID belongs under. Replies
+// to a reply go to the thread of its parent, threads are one level deep.
+func threadRoot(messageID, roomID uint) (*models.Message, error) {
+	var parent models.Message
+	if err := config.DB.First(&parent, messageID).Error; err != nil || parent.RoomID != roomID {
+		return nil, errors.New("parent message not found")
+	}
+	if parent.ParentID != nil {
+		var root models.Message
+		if err := config.DB.First(&root, *parent.ParentID).Error; err != nil {
+			return nil, errors.New("parent message not found")
+		}
+		return &root, nil
+	}
+	return &parent, nil
+}
+
+// threadParticipants lists the thread starter and everyone who replied
+func threadParticipants(parentID uint) ([]models.User, error) {
+	var users []models.User
+	err := config.DB.
+		Unscoped().
+		Select("id, name, username, avatar_url, deleted_at").
+		Where("id IN (?) OR id IN (?)",
+			config.DB.Unscoped().Model(&models.Message{}).Select("sender_id").Where("id = ?", parentID),
+			config.DB.Model(&models.Message{}).Select("sender_id").Where("parent_id = ?", parentID)).
+		Find(&users).Error
+	return users, err
+}
+
+// broadcastThreadUpdated pushes the new reply count and participants of a
+// thread so clients can update the parent without reloading the room
+func broadcastThreadUpdated(parentID uint) {
+	var parent models.Message
+	if err := config.DB.Unscoped().First(&parent, parentID).Error; err != nil {
+		return
+	}
+	participants, err := threadParticipants(parentID)
+	if err != nil {
+		return
+	}
+
+	participantIDs := make([]uint, len(participants))
+	for i, user := range participants {
+		participantIDs[i] = user.ID
+	}
+	GetHub().BroadcastEvent(parent.RoomID, map[string]interface{}{
+		"type":            "thread_updated",
+		"parent_id":       parent.ID,
+		"reply_count":     parent.ReplyCount,
+		"last_reply_at":   parent.LastReplyAt,
+		"participant_ids": participantIDs,
+		"timestamp":       time.Now(),
+	})
+}
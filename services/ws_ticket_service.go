@@ -0,0 +1,94 @@
+package services
+
+import (
+	"errors"
+	"my-ecomm/config"
+	"my-ecomm/models"
+	"my-ecomm/utils"
+	"sync"
+	"time"
+)
+
+// wsTicketTTL is how long a client has to open the WebSocket after requesting a ticket
+const wsTicketTTL = 30 * time.Second
+
+// WSTicket authorizes a single WebSocket connection to one room. It carries
+// the credentials of the request that issued it, so the socket is bound to
+// the same session or API key.
+type WSTicket struct {
+	UserID     uint
+	RoomID     uint
+	SessionID  uint
+	APIKeyID   uint
+	AuthMethod string
+	Scopes     []string
+	ExpiresAt  time.Time
+}
+
+// WSTicketService issues one-time tickets kept in process memory, by hash
+type WSTicketService struct {
+	mu      sync.Mutex
+	tickets map[string]*WSTicket
+}
+
+var wsTicketInstance *WSTicketService
+var wsTicketOnce sync.Once
+
+// GetWSTicketService returns the singleton ticket store
+func GetWSTicketService() *WSTicketService {
+	wsTicketOnce.Do(func() {
+		wsTicketInstance = &WSTicketService{tickets: make(map[string]*WSTicket)}
+	})
+	return wsTicketInstance
+}
+
+// IssueTicket returns a ticket for the room if the user is a member of it
+func (s *WSTicketService) IssueTicket(ticket WSTicket) (string, time.Time, error) {
+	var count int64
+	config.DB.
+		Model(&models.RoomMember{}).
+		Where("room_id = ? AND user_id = ?", ticket.RoomID, ticket.UserID).
+		Count(&count)
+	if count == 0 {
+		return "", time.Time{}, errors.New("access denied")
+	}
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return "", time.Time{}, errors.New("failed to generate ticket")
+	}
+	ticket.ExpiresAt = time.Now().Add(wsTicketTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	s.tickets[utils.HashToken(token)] = &ticket
+
+	return token, ticket.ExpiresAt, nil
+}
+
+// RedeemTicket consumes a ticket. It fails if the ticket is unknown, expired,
+// already used or was issued for another room.
+func (s *WSTicketService) RedeemTicket(token string, roomID uint) (*WSTicket, error) {
+	hash := utils.HashToken(token)
+
+	s.mu.Lock()
+	ticket, ok := s.tickets[hash]
+	delete(s.tickets, hash)
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(ticket.ExpiresAt) || ticket.RoomID != roomID {
+		return nil, errors.New("invalid or expired ticket")
+	}
+	return ticket, nil
+}
+
+// pruneLocked drops expired tickets that were never redeemed
+func (s *WSTicketService) pruneLocked() {
+	now := time.Now()
+	for hash, ticket := range s.tickets {
+		if now.After(ticket.ExpiresAt) {
+			delete(s.tickets, hash)
+		}
+	}
+}
@@ -1,48 +1,100 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const (
+	// AccessTokenTTL is the lifetime of a JWT access token
+	AccessTokenTTL = 15 * time.Minute
+
+	// RefreshTokenTTL is the lifetime of a refresh token since it was last rotated
+	RefreshTokenTTL = 30 * 24 * time.Hour
+
+	// AccessTokenType is the "typ" header of access tokens (RFC 9068)
+	AccessTokenType = "at+jwt"
+)
+
 type Claims struct {
-	UserID uint
-	Email  string
+	UserID    uint
+	Email     string
+	SessionID uint
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(UserID uint, email string) (string, error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "default-secret-key"
-	}
+// GenerateToken signs an access token. Services verifying it with the JWKS
+// should check the "typ" header, the issuer (JWT_ISSUER) and the audience
+// (JWT_AUDIENCE).
+func GenerateToken(UserID uint, email string, sessionID uint) (string, error) {
 	claims := Claims{
-		UserID: UserID,
-		Email:  email,
+		UserID:    UserID,
+		Email:     email,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			Issuer:    TokenIssuer(),
+			Audience:  jwt.ClaimStrings{TokenAudience()},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return signToken(claims, AccessTokenType)
 }
+
 func ValidateToken(signedToken string) (*Claims, error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "default-secret-key"
-	}
-	token, err := jwt.ParseWithClaims(signedToken, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+	token, err := jwt.ParseWithClaims(signedToken, &Claims{}, verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(TokenIssuer()),
+		jwt.WithAudience(TokenAudience()),
+		jwt.WithExpirationRequired())
 	if err != nil {
 		return nil, err
 	}
 	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
+	if !ok || !token.Valid || token.Header["typ"] != AccessTokenType {
 		return nil, jwt.ErrTokenInvalidClaims
 	}
 	return claims, nil
 }
+
+// TokenIssuer is the "iss" claim of access tokens
+func TokenIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "my-ecomm"
+}
+
+// TokenAudience is the "aud" claim of access tokens
+func TokenAudience() string {
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return "my-ecomm-api"
+}
+
+// GenerateRefreshToken returns a random opaque token
+func GenerateRefreshToken() (string, error) {
+	return RandomToken(32)
+}
+
+// RandomToken returns n random bytes encoded as URL-safe base64
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 of a token, used to store tokens at rest
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
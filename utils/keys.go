@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one entry of the key ring. Private is nil for retired keys
+// that are only kept to verify tokens issued before a rotation.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// KeyRing holds the key used to sign new tokens and every key still accepted
+// for verification, indexed by the "kid" token header
+type KeyRing struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+var (
+	keyRingMu sync.RWMutex
+	keyRing   *KeyRing
+)
+
+// InitKeys loads the signing keys configured in the environment:
+//
+//   - JWT_KEYS_DIR: directory of PEM keys named <kid>.pem (private, RSA or Ed25519)
+//     or <kid>.pub.pem (public only, for retired keys)
+//   - JWT_ACTIVE_KID: kid of the key used to sign new tokens (optional with a single private key)
+//   - JWT_DEV_EPHEMERAL_KEY=true: generate a throwaway key for local development
+//
+// To rotate, add the new key to the directory and point JWT_ACTIVE_KID at it;
+// tokens signed with the old key stay valid as long as its file is kept.
+func InitKeys() error {
+	var ring *KeyRing
+	var err error
+
+	switch {
+	case os.Getenv("JWT_KEYS_DIR") != "":
+		ring, err = LoadKeyRing(os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_ACTIVE_KID"))
+	case os.Getenv("JWT_DEV_EPHEMERAL_KEY") == "true":
+		log.Println("WARNING: using an ephemeral JWT signing key, tokens will not survive a restart")
+		ring, err = newEphemeralKeyRing()
+	default:
+		err = errors.New("no JWT signing keys configured: set JWT_KEYS_DIR (or JWT_DEV_EPHEMERAL_KEY=true for development)")
+	}
+	if err != nil {
+		return err
+	}
+
+	keyRingMu.Lock()
+	keyRing = ring
+	keyRingMu.Unlock()
+
+	log.Printf("Loaded %d JWT key(s), signing with kid %q", len(ring.keys), ring.active.ID)
+	return nil
+}
+
+// LoadKeyRing reads every key of dir and selects activeKID as the signing key
+func LoadKeyRing(dir, activeKID string) (*KeyRing, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT keys directory: %w", err)
+	}
+
+	ring := &KeyRing{keys: make(map[string]*signingKey)}
+	var privateKIDs []string
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var key *signingKey
+		if kid, ok := strings.CutSuffix(name, ".pub.pem"); ok {
+			key, err = parsePublicKey(kid, data)
+		} else {
+			kid := strings.TrimSuffix(name, ".pem")
+			key, err = parsePrivateKey(kid, data)
+			privateKIDs = append(privateKIDs, kid)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT key %s: %w", name, err)
+		}
+
+		// A private key wins over the public file of the same kid
+		if existing, ok := ring.keys[key.ID]; !ok || existing.Private == nil {
+			ring.keys[key.ID] = key
+		}
+	}
+
+	if activeKID == "" {
+		if len(privateKIDs) != 1 {
+			return nil, errors.New("JWT_ACTIVE_KID must be set when there is not exactly one private key")
+		}
+		activeKID = privateKIDs[0]
+	}
+
+	active, ok := ring.keys[activeKID]
+	if !ok || active.Private == nil {
+		return nil, fmt.Errorf("no private key found for active kid %q", activeKID)
+	}
+	ring.active = active
+
+	return ring, nil
+}
+
+// JWKS returns the public keys of the ring, for /.well-known/jwks.json
+func JWKS() []JWK {
+	keyRingMu.RLock()
+	defer keyRingMu.RUnlock()
+
+	if keyRing == nil {
+		return []JWK{}
+	}
+
+	kids := make([]string, 0, len(keyRing.keys))
+	for kid := range keyRing.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := make([]JWK, 0, len(kids))
+	for _, kid := range kids {
+		key := keyRing.keys[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// signToken signs claims with the active key and sets the kid and typ headers
+func signToken(claims jwt.Claims, typ string) (string, error) {
+	keyRingMu.RLock()
+	ring := keyRing
+	keyRingMu.RUnlock()
+
+	if ring == nil {
+		return "", errors.New("JWT keys not initialized")
+	}
+
+	token := jwt.NewWithClaims(ring.active.Method, claims)
+	token.Header["kid"] = ring.active.ID
+	token.Header["typ"] = typ
+	return token.SignedString(ring.active.Private)
+}
+
+// verificationKey is the jwt.Keyfunc resolving the kid header against the ring
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	keyRingMu.RLock()
+	ring := keyRing
+	keyRingMu.RUnlock()
+
+	if ring == nil {
+		return nil, errors.New("JWT keys not initialized")
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ring.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return key.Public, nil
+}
+
+func parsePrivateKey(kid string, data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Private: key, Public: &key.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Private: key, Public: key.Public()}, nil
+	default:
+		return nil, errors.New("unsupported key type, use RSA or Ed25519")
+	}
+}
+
+func parsePublicKey(kid string, data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PublicKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Public: key}, nil
+	case ed25519.PublicKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Public: key}, nil
+	default:
+		return nil, errors.New("unsupported key type, use RSA or Ed25519")
+	}
+}
+
+func newEphemeralKeyRing() (*KeyRing, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	key := &signingKey{ID: "ephemeral", Method: jwt.SigningMethodEdDSA, Private: priv, Public: pub}
+	return &KeyRing{active: key, keys: map[string]*signingKey{key.ID: key}}, nil
+}
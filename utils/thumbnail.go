@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+)
+
+// maxImagePixels guards against decompression bombs: larger images are
+// stored without a thumbnail
+const maxImagePixels = 50_000_000
+
+// thumbnailSamples is the number of source samples averaged per axis for
+// each thumbnail pixel
+const thumbnailSamples = 4
+
+// ErrImageTooLarge is returned for images above maxImagePixels
+var ErrImageTooLarge = errors.New("image too large")
+
+// ImageSize reads the dimensions of a GIF, JPEG or PNG image from its header
+func ImageSize(r io.Reader) (int, int, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// Thumbnail decodes a GIF, JPEG or PNG image and scales it down to fit in
+// maxSize x maxSize, returning it PNG encoded. Smaller images keep their size.
+func Thumbnail(r io.ReadSeeker, maxSize int) ([]byte, error) {
+	width, height, err := ImageSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if width*height > maxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dstWidth, dstHeight := width, height
+	if width > maxSize || height > maxSize {
+		if width >= height {
+			dstWidth, dstHeight = maxSize, max(1, height*maxSize/width)
+		} else {
+			dstWidth, dstHeight = max(1, width*maxSize/height), maxSize
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleDown(src, dstWidth, dstHeight)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown resizes src by averaging a grid of samples under each destination pixel
+func scaleDown(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	scaleX := float64(bounds.Dx()) / float64(width)
+	scaleY := float64(bounds.Dy()) / float64(height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a uint32
+			for sy := 0; sy < thumbnailSamples; sy++ {
+				for sx := 0; sx < thumbnailSamples; sx++ {
+					px := bounds.Min.X + int((float64(x)+(float64(sx)+0.5)/thumbnailSamples)*scaleX)
+					py := bounds.Min.Y + int((float64(y)+(float64(sy)+0.5)/thumbnailSamples)*scaleY)
+					c := color.NRGBAModel.Convert(src.At(px, py)).(color.NRGBA)
+					r += uint32(c.R)
+					g += uint32(c.G)
+					b += uint32(c.B)
+					a += uint32(c.A)
+				}
+			}
+			n := uint32(thumbnailSamples * thumbnailSamples)
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}